@@ -2,6 +2,7 @@ provider "helmfile" {}
 
 resource "helmfile_embedding_example" "emb1" {
   embedded {
+    key  = "default"
     path = "./helmfile.yaml"
 
     helm_binary = "helm3"
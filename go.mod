@@ -8,9 +8,19 @@ require (
 	github.com/hashicorp/terraform-plugin-sdk v1.0.0
 	github.com/mumoshu/shoal v0.2.18
 	github.com/mumoshu/terraform-provider-eksctl v0.16.1
+	github.com/open-policy-agent/opa v0.42.2
 	github.com/pkg/profile v1.5.0
 	github.com/rs/xid v1.2.1
-	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543
+	github.com/zclconf/go-cty v1.1.0
+	github.com/zclconf/go-cty-yaml v1.0.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	go.opentelemetry.io/proto/otlp v0.16.0
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1
+	google.golang.org/protobuf v1.28.0
 )
 
 replace github.com/fishworks/gofish => github.com/mumoshu/gofish v0.13.1-0.20200908033248-ab2d494fb15c
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/hashicorp/terraform-plugin-sdk/plugin"
 	"github.com/mumoshu/terraform-provider-helmfile/pkg/helmfile"
 	"github.com/mumoshu/terraform-provider-helmfile/pkg/profile"
@@ -9,6 +11,9 @@ import (
 func main() {
 	defer profile.Start().Stop()
 
+	// Send traces of the last operations before Terraform kills the provider
+	defer helmfile.FlushTraces(time.Second)
+
 	plugin.Serve(&plugin.ServeOpts{
 		ProviderFunc: helmfile.Provider})
 }
@@ -0,0 +1,347 @@
+package helmfile
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+	ctyyaml "github.com/zclconf/go-cty-yaml"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+const KeyAuditLog = "audit_log"
+
+// auditRecord is a line in the audit log, which records a cluster-mutating helmfile command run by the provider
+type auditRecord struct {
+	Time          string         `json:"time"`
+	EndTime       string         `json:"end_time"`
+	ResourceID    string         `json:"resource_id"`
+	CorrelationID string         `json:"correlation_id,omitempty"`
+	Operation     string         `json:"operation"`
+	Args          []string       `json:"args"`
+	Kubecontext   string         `json:"kubecontext,omitempty"`
+	Server        string         `json:"server,omitempty"`
+	DiffSHA256    string         `json:"diff_sha256,omitempty"`
+	ExitCode      int            `json:"exit_code"`
+	DurationMS    int64          `json:"duration_ms"`
+	Releases      []auditRelease `json:"releases"`
+	Error         string         `json:"error,omitempty"`
+}
+
+// auditRelease is a release affected by the command
+type auditRelease struct {
+	Name   string `json:"name"`
+	Chart  string `json:"chart,omitempty"`
+	Status string `json:"status"`
+}
+
+// auditLogMu serializes writes to audit logs from release sets processed concurrently
+var auditLogMu sync.Mutex
+
+// runMutatingCommand runs the cluster-mutating helmfile command, records it to the last_operation block of the resource,
+// and writes it to the audit log of the release set, if any.
+//
+// Failures in recording are logged but don't fail the operation,
+// because the command has already changed the cluster by then.
+func runMutatingCommand(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite, cmd *exec.Cmd) (*State, error) {
+	start := time.Now()
+
+	st, err := runCommand(ctx, fs, cmd, NewState(), false)
+
+	end := time.Now()
+
+	var output string
+
+	if st != nil {
+		output = st.Output
+	} else if err != nil {
+		output = err.Error()
+	}
+
+	r := auditRecord{
+		Time:       formatOperationTime(start),
+		EndTime:    formatOperationTime(end),
+		ResourceID: d.Id(),
+		Operation:  auditOperation(cmd.Args),
+		Args:       redactArgs(cmd.Args),
+		ExitCode:   exitCode(err),
+		DurationMS: end.Sub(start).Milliseconds(),
+		Releases:   parseAffectedReleases(output),
+	}
+
+	if l, ok := fs.Logger.(*operationLogger); ok {
+		r.CorrelationID = l.field("correlation_id")
+	}
+
+	// diff_sha256 is preferred as it's the hash of the whole diff, which can be compared to approved_diff_sha256
+	if h := getString(d, KeyDiffSHA256); h != "" {
+		r.DiffSHA256 = h
+	} else if diff := getString(d, KeyDiffOutput); diff != "" {
+		r.DiffSHA256 = diffSHA256(diff)
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	if serr := setLastOperation(d, r); serr != nil {
+		fs.logFields(LogLevelError, "Failed setting "+KeyLastOperation, logField{Key: "error", Value: serr.Error()})
+	}
+
+	if fs.AuditLog == "" {
+		return st, err
+	}
+
+	if kubeconfig, kerr := getKubeconfig(fs); kerr == nil {
+		r.Kubecontext, r.Server = readKubeconfigServer(*kubeconfig, releaseSetKubecontext(fs))
+	}
+
+	if werr := writeAuditRecord(fs.AuditLog, r); werr != nil {
+		fs.logFields(LogLevelError, "Failed writing audit log", logField{Key: "audit_log", Value: fs.AuditLog}, logField{Key: "error", Value: werr.Error()})
+	}
+
+	return st, err
+}
+
+func writeAuditRecord(path string, r auditRecord) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("encoding audit record: %w", err)
+	}
+
+	auditLogMu.Lock()
+	defer auditLogMu.Unlock()
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("creating directory for audit log %s: %w", path, err)
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(j, '\n')); err != nil {
+		return fmt.Errorf("writing audit log %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// auditOperation returns the helmfile subcommand like `apply` or `destroy`
+func auditOperation(args []string) string {
+	for _, op := range []string{"apply", "sync", "destroy"} {
+		for _, a := range args[1:] {
+			if a == op {
+				return op
+			}
+		}
+	}
+
+	return ""
+}
+
+// redactArgs returns args with values of `--set` flags redacted, as they can contain secrets.
+// The path to the binary is replaced with its base name, so that the record doesn't depend on the host.
+func redactArgs(args []string) []string {
+	var redacted []string
+
+	for i, a := range args {
+		if i == 0 {
+			a = filepath.Base(a)
+		} else if args[i-1] == "--set" {
+			kv := strings.SplitN(a, "=", 2)
+			a = kv[0] + "=(redacted)"
+		}
+
+		redacted = append(redacted, a)
+	}
+
+	return redacted
+}
+
+var exitStatus = regexp.MustCompile(`exit status (\d+)`)
+
+// exitCode returns the exit code of the helmfile command from the error returned by sdk.Run,
+// which doesn't preserve *exec.ExitError
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	if m := exitStatus.FindStringSubmatch(err.Error()); m != nil {
+		if code, err := strconv.Atoi(m[1]); err == nil {
+			return code
+		}
+	}
+
+	return -1
+}
+
+var affectedRelease = regexp.MustCompile(`^\s+(\S+) \(([^)]*)\) (\S+)$`)
+
+// parseAffectedReleases reads releases from the summary printed at the end of helmfile apply, sync or destroy, like:
+//
+//	Affected releases are:
+//	  podinfo (sp/podinfo) UPDATED
+//
+// or:
+//
+//	DELETED RELEASES:
+//	NAME
+//	podinfo
+func parseAffectedReleases(output string) []auditRelease {
+	releases := []auditRelease{}
+
+	const (
+		none = iota
+		affected
+		deleted
+		failed
+	)
+
+	section := none
+
+	s := bufio.NewScanner(strings.NewReader(output))
+	for s.Scan() {
+		l := s.Text()
+
+		switch strings.TrimSpace(l) {
+		case "Affected releases are:":
+			section = affected
+			continue
+		case "DELETED RELEASES:":
+			section = deleted
+			continue
+		case "FAILED RELEASES:":
+			section = failed
+			continue
+		case "":
+			section = none
+			continue
+		case "NAME":
+			continue
+		}
+
+		switch section {
+		case affected:
+			if m := affectedRelease.FindStringSubmatch(l); m != nil {
+				releases = append(releases, auditRelease{Name: m[1], Chart: m[2], Status: m[3]})
+			}
+		case deleted:
+			releases = append(releases, auditRelease{Name: strings.Fields(l)[0], Status: "DELETED"})
+		case failed:
+			releases = append(releases, auditRelease{Name: strings.Fields(l)[0], Status: "FAILED"})
+		}
+	}
+
+	return releases
+}
+
+// kubeconfigFile is the subset of the kubeconfig file to find the API server of the current context
+type kubeconfigFile struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server string `json:"server"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+}
+
+// readKubeconfigServer returns the context and the API server URL of it.
+// The current context of the kubeconfig is used when kubecontext is empty.
+// Both are empty when the kubeconfig file is missing or unparsable.
+func readKubeconfigServer(path, kubecontext string) (string, string) {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+
+	var kc kubeconfigFile
+
+	if err := unmarshalYAML(src, &kc); err != nil {
+		return "", ""
+	}
+
+	if kubecontext == "" {
+		kubecontext = kc.CurrentContext
+	}
+
+	for _, c := range kc.Contexts {
+		if c.Name != kubecontext {
+			continue
+		}
+
+		for _, cl := range kc.Clusters {
+			if cl.Name == c.Context.Cluster {
+				return kubecontext, cl.Cluster.Server
+			}
+		}
+	}
+
+	return kubecontext, ""
+}
+
+// helmfileDefaults is the subset of helmfile.yaml to find the kube context shared by all the releases
+type helmfileDefaults struct {
+	HelmDefaults struct {
+		KubeContext string `json:"kubeContext"`
+	} `json:"helmDefaults"`
+}
+
+// releaseSetKubecontext returns the kube context that helmfile runs commands against for the release set,
+// which is the kubecontext of helmfile_release or helmDefaults.kubeContext in helmfile.yaml.
+// It's empty when neither is set, or helmfile.yaml isn't plain YAML, e.g. when it's templated.
+func releaseSetKubecontext(fs *ReleaseSet) string {
+	if fs.Kubecontext != "" {
+		return fs.Kubecontext
+	}
+
+	var h helmfileDefaults
+
+	if err := unmarshalYAML([]byte(fs.Content), &h); err != nil {
+		return ""
+	}
+
+	return h.HelmDefaults.KubeContext
+}
+
+// unmarshalYAML decodes the YAML document into v via JSON, so that v can be described with json tags
+func unmarshalYAML(src []byte, v interface{}) error {
+	ty, err := ctyyaml.Standard.ImpliedType(src)
+	if err != nil {
+		return err
+	}
+
+	cv, err := ctyyaml.Standard.Unmarshal(src, ty)
+	if err != nil {
+		return err
+	}
+
+	j, err := ctyjson.Marshal(cv, ty)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(j, v)
+}
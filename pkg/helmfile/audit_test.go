@@ -0,0 +1,243 @@
+package helmfile
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+func TestParseAffectedReleases(t *testing.T) {
+	apply := `Upgrading release=podinfo, chart=sp/podinfo
+
+UPDATED RELEASES:
+NAME      CHART        VERSION
+podinfo   sp/podinfo     5.1.1
+
+Affected releases are:
+  podinfo (sp/podinfo) UPDATED
+  redis (bitnami/redis) ADDED
+`
+
+	want := []auditRelease{
+		{Name: "podinfo", Chart: "sp/podinfo", Status: "UPDATED"},
+		{Name: "redis", Chart: "bitnami/redis", Status: "ADDED"},
+	}
+
+	if got := parseAffectedReleases(apply); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected releases for apply: want %v, got %v", want, got)
+	}
+
+	destroy := `Deleting podinfo
+release "podinfo" uninstalled
+
+DELETED RELEASES:
+NAME
+podinfo
+`
+
+	want = []auditRelease{{Name: "podinfo", Status: "DELETED"}}
+
+	if got := parseAffectedReleases(destroy); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected releases for destroy: want %v, got %v", want, got)
+	}
+
+	if got := parseAffectedReleases(""); got == nil || len(got) != 0 {
+		t.Errorf("expected an empty list, got %#v", got)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	got := redactArgs([]string{"/usr/local/bin/helmfile", "--file", "helmfile.yaml", "apply", "--set", "db.password=secret"})
+	want := []string{"helmfile", "--file", "helmfile.yaml", "apply", "--set", "db.password=(redacted)"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if got := exitCode(nil); got != 0 {
+		t.Errorf("expected 0, got %d", got)
+	}
+
+	if got := exitCode(errors.New("/usr/local/bin/helmfile: exit status 3\nin ./helmfile.yaml: ...")); got != 3 {
+		t.Errorf("expected 3, got %d", got)
+	}
+
+	if got := exitCode(errors.New("signal: killed")); got != -1 {
+		t.Errorf("expected -1, got %d", got)
+	}
+}
+
+// auditTestKubeconfig has contexts for two clusters, whose current context is prod
+const auditTestKubeconfig = `apiVersion: v1
+kind: Config
+current-context: prod
+clusters:
+- name: staging
+  cluster:
+    server: https://staging.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+    certificate-authority-data: Zm9v
+contexts:
+- name: staging
+  context:
+    cluster: staging
+    user: admin
+- name: prod
+  context:
+    cluster: prod
+    user: admin
+    namespace: default
+users:
+- name: admin
+  user:
+    token: secret
+`
+
+func TestReadKubeconfigServer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kubeconfig")
+
+	if err := ioutil.WriteFile(path, []byte(auditTestKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		kubecontext string
+		wantContext string
+		wantServer  string
+	}{
+		{kubecontext: "", wantContext: "prod", wantServer: "https://prod.example.com"},
+		{kubecontext: "staging", wantContext: "staging", wantServer: "https://staging.example.com"},
+		{kubecontext: "missing", wantContext: "missing", wantServer: ""},
+	}
+
+	for _, tc := range testcases {
+		ctx, server := readKubeconfigServer(path, tc.kubecontext)
+		if ctx != tc.wantContext || server != tc.wantServer {
+			t.Errorf("unexpected context and server for %q: %s, %s", tc.kubecontext, ctx, server)
+		}
+	}
+
+	if ctx, server := readKubeconfigServer(filepath.Join(dir, "missing"), ""); ctx != "" || server != "" {
+		t.Errorf("expected empty results for the missing file, got %s, %s", ctx, server)
+	}
+}
+
+func TestWriteAuditRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.jsonl")
+
+	for _, id := range []string{"a", "b"} {
+		if err := writeAuditRecord(path, auditRecord{ResourceID: id, Operation: "apply", Releases: []auditRelease{}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(bs)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records, got %q", string(bs))
+	}
+
+	var r map[string]interface{}
+
+	if err := json.Unmarshal([]byte(lines[1]), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r["resource_id"] != "b" || r["operation"] != "apply" {
+		t.Errorf("unexpected record: %v", r)
+	}
+}
+
+func TestReleaseSetKubecontext(t *testing.T) {
+	testcases := []struct {
+		name string
+		fs   ReleaseSet
+		want string
+	}{
+		{
+			name: "helmfile_release",
+			fs:   ReleaseSet{Kubecontext: "staging", Content: "helmDefaults:\n  kubeContext: prod\n"},
+			want: "staging",
+		},
+		{
+			name: "helmDefaults",
+			fs:   ReleaseSet{Content: "helmDefaults:\n  kubeContext: staging\nreleases: []\n"},
+			want: "staging",
+		},
+		{
+			name: "unset",
+			fs:   ReleaseSet{Content: "releases: []\n"},
+			want: "",
+		},
+		{
+			name: "templated",
+			fs:   ReleaseSet{Content: "helmDefaults:\n  kubeContext: {{ .Environment.Name }}\n"},
+			want: "",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := releaseSetKubecontext(&tc.fs); got != tc.want {
+				t.Errorf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunMutatingCommand_Kubecontext(t *testing.T) {
+	dir := t.TempDir()
+
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+
+	if err := ioutil.WriteFile(kubeconfig, []byte(auditTestKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	auditLog := filepath.Join(dir, "audit.jsonl")
+
+	// The release is in the staging cluster, while the current context of the kubeconfig is prod
+	fs := &ReleaseSet{
+		Kubeconfig:  kubeconfig,
+		Kubecontext: "staging",
+		AuditLog:    auditLog,
+	}
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{})
+
+	if _, err := runMutatingCommand(&sdk.Context{}, fs, d, exec.Command("true", "apply")); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := ioutil.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r auditRecord
+
+	if err := json.Unmarshal(bs, &r); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Kubecontext != "staging" || r.Server != "https://staging.example.com" {
+		t.Errorf("expected the staging cluster to be recorded, got %s, %s", r.Kubecontext, r.Server)
+	}
+}
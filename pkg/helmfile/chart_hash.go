@@ -0,0 +1,97 @@
+package helmfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const KeyChartHash = "chart_hash"
+
+// localChartDir returns the path to the chart directory when the chart refers to a local chart.
+// A relative path is resolved against the working directory, the same as helmfile does for the helmfile.yaml in it.
+func localChartDir(workingDirectory, chart string) (string, bool) {
+	if chart == "" {
+		return "", false
+	}
+
+	path := chart
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(workingDirectory, chart)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return "", false
+	}
+
+	return path, true
+}
+
+// hashChartDir computes the SHA256 hash of the content of the chart directory.
+//
+// Every file in the directory is included, so that changes to templates, Chart.yaml, values.yaml and dependencies
+// like charts/ and requirements.yaml all change the hash.
+func hashChartDir(dir string) (string, error) {
+	var files []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("walking chart directory %s: %w", dir, err)
+	}
+
+	sort.Strings(files)
+
+	hash := sha256.New()
+
+	for _, f := range files {
+		rel, err := filepath.Rel(dir, f)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(hash, "%s\n", filepath.ToSlash(rel))
+
+		if err := hashFile(hash, f); err != nil {
+			return "", err
+		}
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package helmfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashChartDir(t *testing.T) {
+	dir := t.TempDir()
+
+	write := func(rel, content string) {
+		t.Helper()
+
+		path := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hash := func() string {
+		t.Helper()
+
+		h, err := hashChartDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	write("Chart.yaml", "name: mychart\nversion: 0.1.0\n")
+	write("values.yaml", "replicas: 1\n")
+	write("templates/deployment.yaml", "kind: Deployment\n")
+
+	h1 := hash()
+
+	write(".git/HEAD", "ref: refs/heads/main\n")
+
+	if h := hash(); h != h1 {
+		t.Errorf("hash changed on an edit in a hidden directory")
+	}
+
+	write("templates/deployment.yaml", "kind: StatefulSet\n")
+
+	if h := hash(); h == h1 {
+		t.Errorf("hash didn't change on a template edit")
+	}
+
+	if _, ok := localChartDir(dir, "templates"); !ok {
+		t.Errorf("expected a relative directory to be a local chart")
+	}
+
+	if _, ok := localChartDir(dir, "sp/podinfo"); ok {
+		t.Errorf("expected a remote chart not to be a local chart")
+	}
+}
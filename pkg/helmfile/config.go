@@ -1,13 +1,77 @@
 package helmfile
 
-import "github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
 
 type ProviderInstance struct {
 	MaxDiffOutputLen int
+
+	// ShoalSyncTimeout is the maximum duration to wait for shoal to install binaries and helm plugins
+	ShoalSyncTimeout time.Duration
+
+	// BinaryCacheDir is the directory that shoal installs binaries and helm plugins into.
+	// It can be shared across projects so that the same versions of binaries are not downloaded again and again.
+	BinaryCacheDir string
+
+	// HelmPlugins is the map of helm plugins installed for every release set.
+	// Each release set can override the version or the source of any plugin in it.
+	HelmPlugins map[string]interface{}
+
+	// AuditLog is the path to the JSONL file that records every helmfile command changing the cluster
+	AuditLog string
 }
 
-func New(d *schema.ResourceData) *ProviderInstance {
+func New(d *schema.ResourceData) (*ProviderInstance, error) {
+	timeout, err := time.ParseDuration(d.Get(KeyShoalSyncTimeout).(string))
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", KeyShoalSyncTimeout, err)
+	}
+
+	if err := configureLogging(d.Get(KeyLogLevel).(string), d.Get(KeyLogFormat).(string)); err != nil {
+		return nil, err
+	}
+
+	if err := configureTracing(d.Get(KeyOTLPEndpoint).(string), d.Get(KeyTraceFile).(string)); err != nil {
+		return nil, fmt.Errorf("configuring tracing: %w", err)
+	}
+
 	return &ProviderInstance{
 		MaxDiffOutputLen: d.Get(KeyMaxDiffOutputLen).(int),
+		ShoalSyncTimeout: timeout,
+		BinaryCacheDir:   d.Get(KeyBinaryCacheDir).(string),
+		HelmPlugins:      d.Get(KeyHelmPlugins).(map[string]interface{}),
+		AuditLog:         d.Get(KeyAuditLog).(string),
+	}, nil
+}
+
+// configureReleaseSet propagates the provider configuration to the release set.
+// meta can be nil or of an another type when the release set is embedded into another provider,
+// in which case the release set is left as-is.
+func configureReleaseSet(meta interface{}, fs *ReleaseSet) {
+	p, ok := meta.(*ProviderInstance)
+	if !ok || p == nil {
+		return
+	}
+
+	fs.ShoalSyncTimeout = p.ShoalSyncTimeout
+	fs.BinaryCacheDir = p.BinaryCacheDir
+	fs.AuditLog = p.AuditLog
+
+	if len(p.HelmPlugins) > 0 {
+		plugins := map[string]interface{}{}
+
+		for k, v := range p.HelmPlugins {
+			plugins[k] = v
+		}
+
+		for k, v := range fs.HelmPlugins {
+			plugins[k] = v
+		}
+
+		fs.HelmPlugins = plugins
 	}
 }
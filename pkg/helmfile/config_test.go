@@ -0,0 +1,159 @@
+package helmfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/shoal"
+)
+
+func TestNew_ShoalSyncTimeout(t *testing.T) {
+	testcases := []struct {
+		name    string
+		raw     map[string]interface{}
+		want    time.Duration
+		wantErr bool
+	}{
+		{
+			name: "default",
+			raw:  map[string]interface{}{},
+			want: 60 * time.Second,
+		},
+		{
+			name: "minutes",
+			raw:  map[string]interface{}{KeyShoalSyncTimeout: "5m"},
+			want: 5 * time.Minute,
+		},
+		{
+			name: "mixed units",
+			raw:  map[string]interface{}{KeyShoalSyncTimeout: "1m30s"},
+			want: 90 * time.Second,
+		},
+		{
+			name:    "no unit",
+			raw:     map[string]interface{}{KeyShoalSyncTimeout: "60"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			raw:     map[string]interface{}{KeyShoalSyncTimeout: "soon"},
+			wantErr: true,
+		},
+	}
+
+	s := Provider().(*schema.Provider).Schema
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if v, ok := tc.raw[KeyShoalSyncTimeout]; ok {
+				_, errs := s[KeyShoalSyncTimeout].ValidateFunc(v, KeyShoalSyncTimeout)
+				if got := len(errs) > 0; got != tc.wantErr {
+					t.Errorf("unexpected validation errors: %v", errs)
+				}
+			}
+
+			p, err := New(schema.TestResourceDataRaw(t, s, tc.raw))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", p.ShoalSyncTimeout)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if p.ShoalSyncTimeout != tc.want {
+				t.Errorf("expected %v, got %v", tc.want, p.ShoalSyncTimeout)
+			}
+		})
+	}
+}
+
+func TestShoalRootDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abs := filepath.Join(t.TempDir(), "cache")
+
+	testcases := []struct {
+		name           string
+		binaryCacheDir string
+		want           string
+	}{
+		{
+			name: "default",
+			want: filepath.Join(wd, shoal.DefaultRootDir),
+		},
+		{
+			name:           "relative",
+			binaryCacheDir: "cache",
+			want:           filepath.Join(wd, "cache"),
+		},
+		{
+			name:           "absolute",
+			binaryCacheDir: abs,
+			want:           abs,
+		},
+		{
+			name:           "unclean",
+			binaryCacheDir: abs + "/../cache/",
+			want:           abs,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := shoalRootDir(&ReleaseSet{BinaryCacheDir: tc.binaryCacheDir})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestConfigureReleaseSet_ShoalSettings(t *testing.T) {
+	testcases := []struct {
+		name        string
+		meta        interface{}
+		wantTimeout time.Duration
+		wantDir     string
+	}{
+		{
+			name:        "provider",
+			meta:        &ProviderInstance{ShoalSyncTimeout: 5 * time.Minute, BinaryCacheDir: "/var/cache/helmfile"},
+			wantTimeout: 5 * time.Minute,
+			wantDir:     "/var/cache/helmfile",
+		},
+		{
+			name: "embedded into another provider",
+			meta: struct{}{},
+		},
+		{
+			name: "nil",
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &ReleaseSet{}
+
+			configureReleaseSet(tc.meta, fs)
+
+			if fs.ShoalSyncTimeout != tc.wantTimeout || fs.BinaryCacheDir != tc.wantDir {
+				t.Errorf("unexpected shoal settings: timeout %v, binary cache dir %q", fs.ShoalSyncTimeout, fs.BinaryCacheDir)
+			}
+		})
+	}
+}
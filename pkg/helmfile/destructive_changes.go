@@ -0,0 +1,277 @@
+package helmfile
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// KeyDestructiveChanges is the key of the computed attribute that lists destructive and immutable-field changes in the plan
+const KeyDestructiveChanges = "destructive_changes"
+
+// KeyAllowDestructiveChanges is the key of the attribute to fail plans containing destructive changes when set to false
+const KeyAllowDestructiveChanges = "allow_destructive_changes"
+
+// Classes of changes on resources
+const (
+	// ChangeDestructive is a change that loses data or everything in it, like removing a PersistentVolumeClaim
+	ChangeDestructive = "destructive"
+	// ChangeImmutable is a change on an immutable field, that fails to apply or requires recreating the resource
+	ChangeImmutable = "immutable"
+	// ChangeBenign is any other change
+	ChangeBenign = "benign"
+)
+
+// Kinds of resources whose removal loses data, or every resource in it
+var destructiveRemovalKinds = map[string]bool{
+	"PersistentVolumeClaim":    true,
+	"StatefulSet":              true,
+	"CustomResourceDefinition": true,
+	"Namespace":                true,
+}
+
+// immutableField is a field that can't be changed once the resource is created
+type immutableField struct {
+	// Kind is the kind of resources that has the field. An empty kind matches any kind except ones in ExceptKinds.
+	Kind        string
+	ExceptKinds []string
+	Path        string
+}
+
+var immutableFields = []immutableField{
+	{Kind: "StatefulSet", Path: "spec.volumeClaimTemplates"},
+	{Kind: "Service", Path: "spec.clusterIP"},
+	{Kind: "Service", Path: "spec.clusterIPs"},
+	// Service's selector is the only selector that can be changed
+	{ExceptKinds: []string{"Service"}, Path: "spec.selector"},
+}
+
+func (f immutableField) matches(kind string) bool {
+	if f.Kind != "" && f.Kind != kind {
+		return false
+	}
+
+	for _, k := range f.ExceptKinds {
+		if k == kind {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DestructiveChange is a destructive or immutable-field change on a resource
+type DestructiveChange struct {
+	Release   string
+	Namespace string
+	Kind      string
+	Name      string
+
+	// Class is either ChangeDestructive or ChangeImmutable
+	Class  string
+	Reason string
+}
+
+func (c DestructiveChange) String() string {
+	name := c.Name
+	if c.Namespace != "" {
+		name = c.Namespace + "/" + c.Name
+	}
+
+	return fmt.Sprintf("%s: release %s, %s %s %s", c.Class, c.Release, c.Kind, name, c.Reason)
+}
+
+// checkDestructiveChanges records destructive and immutable-field changes in the diff to destructive_changes,
+// and fails when allow_destructive_changes is false so that they need to be acknowledged before apply.
+//
+// The diff shows only lines around changes, which lack parent keys like `spec:` of changed fields.
+// So when any resource has changed, they are classified from the diff of whole manifests returned by fullDiff instead.
+func checkDestructiveChanges(fs *ReleaseSet, d ResourceReadWrite, diff string, fullDiff func() (string, error)) error {
+	releases := ParseDiffOutput(diff)
+
+	if hasChangedResources(releases) {
+		full, err := fullDiff()
+		if err != nil {
+			return fmt.Errorf("diffing whole manifests to detect destructive changes: %w", err)
+		}
+
+		releases = ParseDiffOutput(full)
+	}
+
+	changes := DestructiveChanges(releases)
+
+	cs := []string{}
+
+	for _, c := range changes {
+		cs = append(cs, c.String())
+	}
+
+	if err := d.Set(KeyDestructiveChanges, cs); err != nil {
+		return fmt.Errorf("setting %s: %w", KeyDestructiveChanges, err)
+	}
+
+	if len(cs) == 0 {
+		return nil
+	}
+
+	allow := true
+
+	if v := d.Get(KeyAllowDestructiveChanges); v != nil {
+		allow = v.(bool)
+	}
+
+	if allow {
+		fs.logf("Detected destructive changes: %s", strings.Join(cs, ", "))
+
+		return nil
+	}
+
+	return fmt.Errorf("detected %d destructive changes:\n%s\n"+
+		"Review them and set %s to true to proceed", len(cs), strings.Join(cs, "\n"), KeyAllowDestructiveChanges)
+}
+
+// DestructiveChanges returns destructive and immutable-field changes in the diff parsed by ParseDiffOutput
+func DestructiveChanges(releases []ReleaseDiff) []DestructiveChange {
+	var changes []DestructiveChange
+
+	for _, rel := range releases {
+		for _, r := range rel.Resources {
+			class, reason := ClassifyResourceDiff(r)
+			if class == ChangeBenign {
+				continue
+			}
+
+			changes = append(changes, DestructiveChange{
+				Release:   rel.Name,
+				Namespace: r.Namespace,
+				Kind:      r.Kind,
+				Name:      r.Name,
+				Class:     class,
+				Reason:    reason,
+			})
+		}
+	}
+
+	return changes
+}
+
+func hasChangedResources(releases []ReleaseDiff) bool {
+	for _, rel := range releases {
+		for _, r := range rel.Resources {
+			if r.Change == ResourceChanged {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ClassifyResourceDiff returns the class of the change on the resource, and the reason for non-benign changes.
+// Changed resources are classified by comparing immutable fields of the old and the new manifests in the diff,
+// which needs to contain whole manifests.
+func ClassifyResourceDiff(r ResourceDiff) (string, string) {
+	switch r.Change {
+	case ResourceRemoved:
+		if destructiveRemovalKinds[r.Kind] {
+			return ChangeDestructive, "has been removed"
+		}
+	case ResourceChanged:
+		var fields []immutableField
+
+		for _, f := range immutableFields {
+			if f.matches(r.Kind) {
+				fields = append(fields, f)
+			}
+		}
+
+		if len(fields) == 0 {
+			break
+		}
+
+		old, new, err := diffManifests(r.Diff)
+		if err != nil {
+			// Immutable fields might have changed, so the change needs to be reviewed like other immutable-field changes
+			return ChangeImmutable, fmt.Sprintf("has changed, but its immutable fields couldn't be checked: %v", err)
+		}
+
+		for _, f := range fields {
+			if !reflect.DeepEqual(fieldValue(old, f.Path), fieldValue(new, f.Path)) {
+				return ChangeImmutable, fmt.Sprintf("changes immutable field %s", f.Path)
+			}
+		}
+	}
+
+	return ChangeBenign, ""
+}
+
+// diffManifests returns the old and the new manifests in the helm-diff output of a resource.
+// helm-diff prints each line of the manifest prefixed by two characters, that are `- ` for removed lines,
+// `+ ` for added lines and two spaces for unchanged lines.
+// It fails when lines are elided, which helm-diff shows as `...` when run with `--context`.
+func diffManifests(diff string) (map[string]interface{}, map[string]interface{}, error) {
+	var olds, news []string
+
+	for _, l := range strings.Split(strings.TrimRight(diff, "\n"), "\n") {
+		if l == "..." {
+			return nil, nil, errors.New("the diff doesn't contain whole manifests")
+		}
+
+		if len(l) < 2 {
+			olds = append(olds, "")
+			news = append(news, "")
+
+			continue
+		}
+
+		switch marker, content := l[:2], l[2:]; marker {
+		case "- ":
+			olds = append(olds, content)
+		case "+ ":
+			news = append(news, content)
+		case "  ":
+			olds = append(olds, content)
+			news = append(news, content)
+		default:
+			return nil, nil, fmt.Errorf("unexpected line in the diff: %q", l)
+		}
+	}
+
+	old, err := parseManifest(olds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing the old manifest: %w", err)
+	}
+
+	new, err := parseManifest(news)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing the new manifest: %w", err)
+	}
+
+	return old, new, nil
+}
+
+func parseManifest(lines []string) (map[string]interface{}, error) {
+	objs, err := parseManifests([]byte(strings.Join(lines, "\n")))
+	if err != nil || len(objs) == 0 {
+		return nil, err
+	}
+
+	return objs[0], nil
+}
+
+// fieldValue returns the value at the dot-separated path in the manifest, or nil when it's missing
+func fieldValue(obj map[string]interface{}, path string) interface{} {
+	var v interface{} = obj
+
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		v = m[k]
+	}
+
+	return v
+}
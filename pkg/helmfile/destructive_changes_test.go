@@ -0,0 +1,281 @@
+package helmfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+const destructiveChangesTestDiff = `Comparing release=db, chart=bitnami/postgresql
+default, data-db-0, PersistentVolumeClaim (v1) has been removed:
+- apiVersion: v1
+- kind: PersistentVolumeClaim
+
+default, db, StatefulSet (apps) has changed:
+  spec:
+    replicas: 1
+    volumeClaimTemplates:
+    - metadata:
+        name: data
+      spec:
+        resources:
+          requests:
+-           storage: 8Gi
++           storage: 16Gi
+
+default, db, Service (v1) has changed:
+  spec:
+-   clusterIP: 10.0.0.1
++   clusterIP: 10.0.0.2
+    selector:
+-     app: db
++     app: postgresql
+
+Comparing release=podinfo, chart=sp/podinfo
+default, podinfo, Deployment (apps) has changed:
+  spec:
+-   replicas: 1
++   replicas: 2
+    selector:
+      matchLabels:
+-       app: podinfo
++       app: podinfo-v2
+    template:
+      spec:
+        containers:
+        - name: podinfo
+-         image: podinfo:1.0
++         image: podinfo:2.0
+
+default, podinfo-config, ConfigMap (v1) has been removed:
+- apiVersion: v1
+`
+
+// elidedStatefulSetDiff is the output of `helmfile diff --context 3` for the change on the size of volumeClaimTemplates.
+// helm-diff elides lines more than 3 lines away from changes with `...`, including `spec:` and `volumeClaimTemplates:`.
+const elidedStatefulSetDiff = `Comparing release=db, chart=bitnami/postgresql
+default, db-postgresql, StatefulSet (apps) has changed:
+...
+                - key: app.kubernetes.io/instance
+                  operator: In
+                  values:
+-                 - db
++                 - db-v2
+...
+          resources:
+            requests:
+-             storage: "8Gi"
++             storage: "16Gi"
+`
+
+// fullStatefulSetDiff is the output of `helmfile diff` without --context for the same change
+const fullStatefulSetDiff = `Comparing release=db, chart=bitnami/postgresql
+default, db-postgresql, StatefulSet (apps) has changed:
+  # Source: postgresql/templates/statefulset.yaml
+  apiVersion: apps/v1
+  kind: StatefulSet
+  metadata:
+    name: db-postgresql
+    labels:
+      app.kubernetes.io/name: postgresql
+  spec:
+    serviceName: db-postgresql-headless
+    replicas: 1
+    selector:
+      matchLabels:
+        app.kubernetes.io/name: postgresql
+    template:
+      metadata:
+        labels:
+          app.kubernetes.io/name: postgresql
+      spec:
+        affinity:
+          podAntiAffinity:
+            preferredDuringSchedulingIgnoredDuringExecution:
+            - weight: 1
+              podAffinityTerm:
+                labelSelector:
+                  matchExpressions:
+                  - key: app.kubernetes.io/instance
+                    operator: In
+                    values:
+-                   - db
++                   - db-v2
+        containers:
+        - name: postgresql
+          image: docker.io/bitnami/postgresql:11.10.0
+    volumeClaimTemplates:
+      - metadata:
+          name: data
+        spec:
+          accessModes:
+            - "ReadWriteOnce"
+          resources:
+            requests:
+-             storage: "8Gi"
++             storage: "16Gi"
+`
+
+func TestDestructiveChanges(t *testing.T) {
+	var got []string
+
+	for _, c := range DestructiveChanges(ParseDiffOutput(destructiveChangesTestDiff)) {
+		got = append(got, c.String())
+	}
+
+	want := []string{
+		"destructive: release db, PersistentVolumeClaim default/data-db-0 has been removed",
+		"immutable: release db, StatefulSet default/db changes immutable field spec.volumeClaimTemplates",
+		"immutable: release db, Service default/db changes immutable field spec.clusterIP",
+		"immutable: release podinfo, Deployment default/podinfo changes immutable field spec.selector",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected destructive changes:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestClassifyResourceDiff_Benign(t *testing.T) {
+	for _, r := range []ResourceDiff{
+		{Kind: "StatefulSet", Change: ResourceAdded, Diff: "+ apiVersion: apps/v1\n"},
+		{Kind: "StatefulSet", Change: ResourceChanged, Diff: "  spec:\n-   replicas: 1\n+   replicas: 2\n    volumeClaimTemplates:\n    - metadata:\n        name: data\n"},
+		{Kind: "Service", Change: ResourceChanged, Diff: "  spec:\n    selector:\n-     app: a\n+     app: b\n"},
+		{Kind: "ConfigMap", Change: ResourceRemoved, Diff: "- apiVersion: v1\n"},
+	} {
+		if class, reason := ClassifyResourceDiff(r); class != ChangeBenign {
+			t.Errorf("expected the change on %s to be benign, got %s: %s", r.Kind, class, reason)
+		}
+	}
+}
+
+func TestClassifyResourceDiff_ElidedDiff(t *testing.T) {
+	r := ParseDiffOutput(elidedStatefulSetDiff)[0].Resources[0]
+
+	// Parent keys of the changed field are elided, so the change can't be told benign
+	if class, reason := ClassifyResourceDiff(r); class != ChangeImmutable {
+		t.Errorf("expected the elided change to need a review, got %s: %s", class, reason)
+	}
+}
+
+func TestCheckDestructiveChanges(t *testing.T) {
+	newData := func(allow bool) *schema.ResourceData {
+		return schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+			KeyAllowDestructiveChanges: allow,
+		})
+	}
+
+	fs := &ReleaseSet{}
+
+	fullDiff := func(diff string) func() (string, error) {
+		return func() (string, error) {
+			return diff, nil
+		}
+	}
+
+	d := newData(true)
+
+	if err := checkDestructiveChanges(fs, d, destructiveChangesTestDiff, fullDiff(destructiveChangesTestDiff)); err != nil {
+		t.Fatalf("expected destructive changes to be allowed: %v", err)
+	}
+
+	if n := len(d.Get(KeyDestructiveChanges).([]interface{})); n != 4 {
+		t.Errorf("expected 4 destructive changes to be recorded, got %d", n)
+	}
+
+	err := checkDestructiveChanges(fs, newData(false), destructiveChangesTestDiff, fullDiff(destructiveChangesTestDiff))
+	if err == nil || !strings.Contains(err.Error(), "detected 4 destructive changes") {
+		t.Errorf("expected destructive changes to block the plan, got %v", err)
+	}
+
+	if err := checkDestructiveChanges(fs, newData(false), approvalTestDiff, fullDiff(approvalTestDiff)); err != nil {
+		t.Errorf("expected benign changes not to block the plan: %v", err)
+	}
+}
+
+func TestDiffReleaseSet_DestructiveChangesGone(t *testing.T) {
+	dir := t.TempDir()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// runDiff creates temporary directories under .terraform in the current directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+
+	// helmfile-diff exits with 0 and prints nothing when there are no changes
+	if err := ioutil.WriteFile(filepath.Join(dir, "helmfile"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &ReleaseSet{
+		Bin:              filepath.Join(dir, "helmfile"),
+		Content:          "releases: []\n",
+		Kubeconfig:       filepath.Join(dir, "kubeconfig"),
+		WorkingDirectory: dir,
+	}
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig: fs.Kubeconfig,
+	})
+
+	// Recorded by the previous plan
+	if err := d.Set(KeyDestructiveChanges, []string{"destructive: release db, PersistentVolumeClaim default/data-db-0 has been removed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	diff, err := DiffReleaseSet(&sdk.Context{}, fs, d)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if diff != "" {
+		t.Fatalf("expected no changes, got %q", diff)
+	}
+
+	if cs := d.Get(KeyDestructiveChanges).([]interface{}); len(cs) != 0 {
+		t.Errorf("expected destructive changes to be cleared, got %v", cs)
+	}
+}
+
+func TestDiffReleaseSet_ImmutableChangeInElidedDiff(t *testing.T) {
+	fs := newFakeHelmfileReleaseSet(t, "")
+
+	// The elided diff is printed with --context, and the whole manifests without it
+	script := "#!/bin/sh\ncase \" $* \" in\n*\" --context \"*)\ncat <<'EOF'\n" + elidedStatefulSetDiff + "EOF\n;;\n*)\ncat <<'EOF'\n" + fullStatefulSetDiff + "EOF\n;;\nesac\nexit 2\n"
+
+	if err := ioutil.WriteFile(fs.Bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig: fs.Kubeconfig,
+	})
+
+	diff, err := DiffReleaseSet(&sdk.Context{}, fs, d)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(diff, "...") {
+		t.Errorf("expected the elided diff to be planned, got %q", diff)
+	}
+
+	want := []interface{}{"immutable: release db, StatefulSet default/db-postgresql changes immutable field spec.volumeClaimTemplates"}
+
+	if got := d.Get(KeyDestructiveChanges).([]interface{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected destructive changes: want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,84 @@
+package helmfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+// KeyDiffSHA256 is the key of the computed attribute for the SHA256 hash of the whole helmfile-diff output,
+// which is computed before diff_output is snipped according to max_diff_output_len
+const KeyDiffSHA256 = "diff_sha256"
+
+// KeyApprovedDiffSHA256 is the key of the attribute for the diff_sha256 of the reviewed plan
+const KeyApprovedDiffSHA256 = "approved_diff_sha256"
+
+func diffSHA256(diff string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(diff)))
+}
+
+// liveDiff runs helmfile-diff with the configuration used on plan, bypassing the diff file cached on plan
+func liveDiff(ctx *sdk.Context, fs *ReleaseSet, conf DiffConfig) (string, error) {
+	st, err := runDiff(ctx, fs, conf)
+	if err != nil {
+		return "", fmt.Errorf("running helmfile diff: %w", err)
+	}
+
+	if st.Output == "" {
+		return "", nil
+	}
+
+	return removeNondeterministicTemplateAndDiffLogLines(st.Output)
+}
+
+// verifyDiffBeforeApply re-runs helmfile-diff right before apply when approved_diff_sha256 or verify_plan_on_apply is set,
+// and fails when the live diff isn't what was reviewed or planned.
+//
+// This makes sure that what gets applied is exactly what was reviewed,
+// even when the cluster or the chart repositories changed after the plan.
+// conf needs to be the one used on plan, so that the live diff is comparable to the planned one.
+func verifyDiffBeforeApply(ctx *sdk.Context, fs *ReleaseSet, d ResourceRead, conf DiffConfig) error {
+	approved := getString(d, KeyApprovedDiffSHA256)
+
+	var verifyPlan bool
+
+	if v := d.Get(KeyVerifyPlanOnApply); v != nil {
+		verifyPlan = v.(bool)
+	}
+
+	if approved == "" && !verifyPlan {
+		return nil
+	}
+
+	// The planned diff needs to be read before running diff, which could overwrite the diff file
+	var planned string
+
+	if verifyPlan {
+		planned = plannedDiff(ctx, fs, d)
+	}
+
+	live, err := liveDiff(ctx, fs, conf)
+	if err != nil {
+		return fmt.Errorf("verifying diff before apply: %w", err)
+	}
+
+	if approved != "" {
+		if h := diffSHA256(live); h != approved {
+			return fmt.Errorf("refusing to apply: the SHA256 hash of the live diff %s doesn't match %s %s. "+
+				"Re-run plan to review the latest changes and update %s", h, KeyApprovedDiffSHA256, approved, KeyApprovedDiffSHA256)
+		}
+
+		fs.logf("Verified that the live diff matches %s %s", KeyApprovedDiffSHA256, approved)
+	}
+
+	if verifyPlan {
+		if err := verifyPlannedDiff(planned, live, getString(d, KeyDiffSHA256)); err != nil {
+			return err
+		}
+
+		fs.logf("Verified that the live diff matches the planned diff")
+	}
+
+	return nil
+}
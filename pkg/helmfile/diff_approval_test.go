@@ -0,0 +1,160 @@
+package helmfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+const approvalTestDiff = `Comparing release=podinfo, chart=sp/podinfo
+default, podinfo, Deployment (apps) has changed:
+-   replicas: 1
++   replicas: 2
+`
+
+// newFakeHelmfileReleaseSet returns the release set that runs the script printing the diff instead of helmfile
+func newFakeHelmfileReleaseSet(t *testing.T, diff string) *ReleaseSet {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// runDiff creates temporary directories under .terraform in the current directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+
+	bin := filepath.Join(dir, "helmfile")
+	script := "#!/bin/sh\ncat <<'EOF'\n" + diff + "EOF\nexit 2\n"
+
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return &ReleaseSet{
+		Bin:              bin,
+		Content:          "releases: []\n",
+		Kubeconfig:       filepath.Join(dir, "kubeconfig"),
+		WorkingDirectory: dir,
+	}
+}
+
+func TestVerifyDiffBeforeApply_ApprovedDiffSHA256(t *testing.T) {
+	fs := newFakeHelmfileReleaseSet(t, approvalTestDiff)
+
+	newData := func(approved string) *schema.ResourceData {
+		return schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+			KeyKubeconfig:         fs.Kubeconfig,
+			KeyApprovedDiffSHA256: approved,
+		})
+	}
+
+	if err := verifyDiffBeforeApply(&sdk.Context{}, fs, newData(""), DiffConfig{}); err != nil {
+		t.Errorf("expected no verification without approved_diff_sha256: %v", err)
+	}
+
+	if err := verifyDiffBeforeApply(&sdk.Context{}, fs, newData(diffSHA256(approvalTestDiff)), DiffConfig{}); err != nil {
+		t.Errorf("expected the approved diff to be verified: %v", err)
+	}
+
+	err := verifyDiffBeforeApply(&sdk.Context{}, fs, newData(diffSHA256("outdated")), DiffConfig{})
+	if err == nil || !strings.Contains(err.Error(), "refusing to apply") {
+		t.Errorf("expected the outdated approval to be refused, got %v", err)
+	}
+}
+
+func TestVerifyDiffBeforeApply_VerifyPlanOnApply(t *testing.T) {
+	fs := newFakeHelmfileReleaseSet(t, approvalTestDiff)
+
+	newData := func(planned string) *schema.ResourceData {
+		return schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+			KeyKubeconfig:        fs.Kubeconfig,
+			KeyDiffOutput:        planned,
+			KeyVerifyPlanOnApply: true,
+		})
+	}
+
+	// Trailing whitespaces and log lines are ignored
+	planned := "Adding repo sp https://stefanprodan.github.io/podinfo\n\n" + strings.ReplaceAll(approvalTestDiff, "\n", "  \n")
+
+	if err := verifyDiffBeforeApply(&sdk.Context{}, fs, newData(planned), DiffConfig{}); err != nil {
+		t.Errorf("expected the planned diff to be verified: %v", err)
+	}
+
+	err := verifyDiffBeforeApply(&sdk.Context{}, fs, newData(strings.Replace(approvalTestDiff, "replicas: 2", "replicas: 3", 1)), DiffConfig{})
+	if err == nil {
+		t.Fatal("expected the outdated plan to be refused")
+	}
+
+	for _, want := range []string{
+		"refusing to apply",
+		"release podinfo, Deployment (apps) default/podinfo: planned changed, live changed",
+		"+   replicas: 3",
+		"| +   replicas: 2",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to contain %q, got:\n%s", want, err)
+		}
+	}
+}
+
+func TestVerifyDiffBeforeApply_LargeDiff(t *testing.T) {
+	// The diff exceeds the 8KB of the output kept by sdk.Context.Run
+	var b strings.Builder
+
+	b.WriteString("Comparing release=podinfo, chart=sp/podinfo\n")
+
+	for i := 0; i < 200; i++ {
+		b.WriteString(fmt.Sprintf("default, podinfo-%d, ConfigMap (v1) has changed:\n-   key: old\n+   key: new\n", i))
+	}
+
+	diff := b.String()
+
+	fs := newFakeHelmfileReleaseSet(t, diff)
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig:         fs.Kubeconfig,
+		KeyApprovedDiffSHA256: diffSHA256(diff),
+	})
+
+	if err := verifyDiffBeforeApply(&sdk.Context{}, fs, d, DiffConfig{}); err != nil {
+		t.Errorf("expected the whole diff to be hashed: %v", err)
+	}
+}
+
+func TestVerifyDiffBeforeApply_DiffConfig(t *testing.T) {
+	fs := newFakeHelmfileReleaseSet(t, "")
+
+	// The diff contains the kubeconfig helmfile-diff was run with
+	script := "#!/bin/sh\necho \"Comparing release=podinfo, kubeconfig=$KUBECONFIG\"\nexit 2\n"
+
+	if err := ioutil.WriteFile(fs.Bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	kubeconfig := filepath.Join(fs.WorkingDirectory, "parent-kubeconfig")
+	planned := "Comparing release=podinfo, kubeconfig=" + kubeconfig + "\n"
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig:         fs.Kubeconfig,
+		KeyApprovedDiffSHA256: diffSHA256(planned),
+	})
+
+	if err := verifyDiffBeforeApply(&sdk.Context{}, fs, d, DiffConfig{Kubeconfig: kubeconfig}); err != nil {
+		t.Errorf("expected the diff to be run with the configuration used on plan: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package helmfile
+
+import (
+	"bufio"
+	"regexp"
+	"strings"
+)
+
+const (
+	ResourceAdded   = "added"
+	ResourceChanged = "changed"
+	ResourceRemoved = "removed"
+)
+
+// ReleaseDiff is the set of changes helmfile-diff detected for a release
+type ReleaseDiff struct {
+	Name  string
+	Chart string
+
+	Resources []ResourceDiff
+}
+
+// ResourceDiff is a change on a Kubernetes resource detected by helm-diff
+type ResourceDiff struct {
+	Namespace string
+	Name      string
+	Kind      string
+
+	// APIGroup is the API group of the resource, that is empty for core resources like ConfigMap
+	APIGroup string
+
+	// Change is one of ResourceAdded, ResourceChanged and ResourceRemoved
+	Change string
+
+	// Diff is the unified diff of the resource as printed by helm-diff
+	Diff string
+}
+
+var (
+	diffComparingRelease = regexp.MustCompile(`^Comparing release=([^,]+), chart=(.+)$`)
+	diffResourceHeader   = regexp.MustCompile(`^([^,]*), ([^,]+), ([^ ,]+)(?: \(([^)]*)\))? (has been added|has changed|has been removed):$`)
+)
+
+var diffChanges = map[string]string{
+	"has been added":   ResourceAdded,
+	"has changed":      ResourceChanged,
+	"has been removed": ResourceRemoved,
+}
+
+// ParseDiffOutput parses helmfile-diff output into changes per release and resource.
+// Only releases with one or more changed resources are returned.
+// Lines that are not part of any resource diff, like `helm repo add` logs, are ignored.
+func ParseDiffOutput(output string) []ReleaseDiff {
+	var (
+		releases []ReleaseDiff
+		body     []string
+	)
+
+	flush := func() {
+		if len(releases) == 0 {
+			return
+		}
+
+		rel := &releases[len(releases)-1]
+		if len(rel.Resources) == 0 {
+			return
+		}
+
+		for len(body) > 0 && strings.TrimSpace(body[len(body)-1]) == "" {
+			body = body[:len(body)-1]
+		}
+
+		res := &rel.Resources[len(rel.Resources)-1]
+		if res.Diff == "" && len(body) > 0 {
+			res.Diff = strings.Join(body, "\n") + "\n"
+		}
+
+		body = nil
+	}
+
+	s := bufio.NewScanner(strings.NewReader(output))
+	s.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	for s.Scan() {
+		l := s.Text()
+
+		if m := diffComparingRelease.FindStringSubmatch(l); m != nil {
+			flush()
+
+			releases = append(releases, ReleaseDiff{Name: m[1], Chart: m[2]})
+
+			continue
+		}
+
+		if m := diffResourceHeader.FindStringSubmatch(l); m != nil {
+			flush()
+
+			// helm-diff output without helmfile's `Comparing release` line, which happens when the release is unknown
+			if len(releases) == 0 {
+				releases = append(releases, ReleaseDiff{})
+			}
+
+			rel := &releases[len(releases)-1]
+			rel.Resources = append(rel.Resources, ResourceDiff{
+				Namespace: m[1],
+				Name:      m[2],
+				Kind:      m[3],
+				APIGroup:  m[4],
+				Change:    diffChanges[m[5]],
+			})
+
+			continue
+		}
+
+		if l == "Affected releases are:" {
+			flush()
+
+			break
+		}
+
+		if len(releases) > 0 && len(releases[len(releases)-1].Resources) > 0 {
+			body = append(body, l)
+		}
+	}
+
+	flush()
+
+	// helmfile prints `Comparing release` for every release, including ones without any change
+	var changed []ReleaseDiff
+
+	for _, r := range releases {
+		if len(r.Resources) > 0 {
+			changed = append(changed, r)
+		}
+	}
+
+	return changed
+}
@@ -0,0 +1,79 @@
+package helmfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiffOutput(t *testing.T) {
+	output := `Adding repo sp https://stefanprodan.github.io/podinfo
+"sp" has been added to your repositories
+
+Comparing release=podinfo, chart=sp/podinfo
+default, podinfo, Deployment (apps) has changed:
+  # Source: podinfo/templates/deployment.yaml
+  apiVersion: apps/v1
+-   replicas: 1
++   replicas: 2
+
+default, podinfo-extra, ConfigMap (v1) has been added:
++ apiVersion: v1
++ kind: ConfigMap
+
+Comparing release=unchanged, chart=sp/podinfo
+Comparing release=crds, chart=./crds
+, foos.example.com, CustomResourceDefinition (apiextensions.k8s.io) has been removed:
+- apiVersion: apiextensions.k8s.io/v1
+
+Affected releases are:
+  podinfo (sp/podinfo) UPDATED
+`
+
+	want := []ReleaseDiff{
+		{
+			Name:  "podinfo",
+			Chart: "sp/podinfo",
+			Resources: []ResourceDiff{
+				{
+					Namespace: "default",
+					Name:      "podinfo",
+					Kind:      "Deployment",
+					APIGroup:  "apps",
+					Change:    ResourceChanged,
+					Diff:      "  # Source: podinfo/templates/deployment.yaml\n  apiVersion: apps/v1\n-   replicas: 1\n+   replicas: 2\n",
+				},
+				{
+					Namespace: "default",
+					Name:      "podinfo-extra",
+					Kind:      "ConfigMap",
+					APIGroup:  "v1",
+					Change:    ResourceAdded,
+					Diff:      "+ apiVersion: v1\n+ kind: ConfigMap\n",
+				},
+			},
+		},
+		{
+			Name:  "crds",
+			Chart: "./crds",
+			Resources: []ResourceDiff{
+				{
+					Name:     "foos.example.com",
+					Kind:     "CustomResourceDefinition",
+					APIGroup: "apiextensions.k8s.io",
+					Change:   ResourceRemoved,
+					Diff:     "- apiVersion: apiextensions.k8s.io/v1\n",
+				},
+			},
+		},
+	}
+
+	got := ParseDiffOutput(output)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected result:\nwant: %+v\ngot:  %+v", want, got)
+	}
+
+	if got := ParseDiffOutput(""); len(got) != 0 {
+		t.Errorf("expected no changes for empty output, got %+v", got)
+	}
+}
@@ -0,0 +1,219 @@
+package helmfile
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+const (
+	// KeyParallelism is the key of the attribute for the maximum number of embedded release sets processed concurrently
+	KeyParallelism = "parallelism"
+
+	// KeyEmbeddedNeeds is the key of the attribute for keys of embedded release sets that the release set depends on
+	KeyEmbeddedNeeds = "needs"
+)
+
+// DefaultEmbeddedParallelism is the number of embedded release sets processed concurrently by default
+const DefaultEmbeddedParallelism = 1
+
+// embeddedError is the error on processing an embedded release set
+type embeddedError struct {
+	Key string
+	Err error
+}
+
+// embeddedErrors is the list of errors on processing embedded release sets, each of which names the failed entry
+type embeddedErrors []embeddedError
+
+func (errs embeddedErrors) Error() string {
+	var lines []string
+
+	for _, e := range errs {
+		lines = append(lines, fmt.Sprintf("embedded release set %q: %v", e.Key, e.Err))
+	}
+
+	return fmt.Sprintf("%d embedded release set(s) failed:\n%s", len(errs), strings.Join(lines, "\n"))
+}
+
+func getEmbeddedNeeds(fs *ResourceReadWriteEmbedded) []string {
+	var needs []string
+
+	vs, _ := fs.Get(KeyEmbeddedNeeds).([]interface{})
+
+	for _, v := range vs {
+		needs = append(needs, fmt.Sprintf("%v", v))
+	}
+
+	return needs
+}
+
+// validateEmbeddedNeeds makes sure that every `needs` refers to another embedded release set and there's no cycle
+func validateEmbeddedNeeds(resources []*ResourceReadWriteEmbedded) error {
+	byKey := map[string]*ResourceReadWriteEmbedded{}
+
+	for _, fs := range resources {
+		byKey[fs.Id()] = fs
+	}
+
+	for _, fs := range resources {
+		for _, n := range getEmbeddedNeeds(fs) {
+			if _, ok := byKey[n]; !ok {
+				return fmt.Errorf("validating embedded release set %q: needs unknown release set %q", fs.Id(), n)
+			}
+		}
+	}
+
+	_, err := embeddedDependencies(resources, false)
+
+	return err
+}
+
+// embeddedDependencies returns keys of embedded release sets that each release set waits for.
+// Needs referring to release sets not in resources are ignored, so that a subset of release sets can be processed.
+//
+// With reverse=true, a release set waits for the ones that need it, which is the order to destroy them.
+func embeddedDependencies(resources []*ResourceReadWriteEmbedded, reverse bool) (map[string][]string, error) {
+	keys := map[string]bool{}
+
+	for _, fs := range resources {
+		keys[fs.Id()] = true
+	}
+
+	deps := map[string][]string{}
+
+	for _, fs := range resources {
+		for _, n := range getEmbeddedNeeds(fs) {
+			if !keys[n] {
+				continue
+			}
+
+			if reverse {
+				deps[n] = append(deps[n], fs.Id())
+			} else {
+				deps[fs.Id()] = append(deps[fs.Id()], n)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	state := map[string]int{}
+
+	var visit func(k string, path []string) error
+
+	visit = func(k string, path []string) error {
+		switch state[k] {
+		case visiting:
+			return fmt.Errorf("validating embedded release sets: dependency cycle detected: %s", strings.Join(append(path, k), " -> "))
+		case visited:
+			return nil
+		}
+
+		state[k] = visiting
+
+		for _, d := range deps[k] {
+			if err := visit(d, append(path, k)); err != nil {
+				return err
+			}
+		}
+
+		state[k] = visited
+
+		return nil
+	}
+
+	for _, fs := range resources {
+		if err := visit(fs.Id(), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return deps, nil
+}
+
+// runEmbedded calls f for every embedded release set, running up to parallelism calls concurrently.
+//
+// A release set is processed only after all the release sets it needs are processed successfully,
+// or in the reverse order when reverse=true.
+// The returned error is embeddedErrors that names every release set that failed or was skipped due to a failed dependency.
+func runEmbedded(resources []*ResourceReadWriteEmbedded, parallelism int, reverse bool, f func(*ResourceReadWriteEmbedded) error) error {
+	deps, err := embeddedDependencies(resources, reverse)
+	if err != nil {
+		return err
+	}
+
+	if parallelism < 1 {
+		parallelism = DefaultEmbeddedParallelism
+	}
+
+	done := map[string]chan struct{}{}
+
+	for _, fs := range resources {
+		done[fs.Id()] = make(chan struct{})
+	}
+
+	var (
+		mu     sync.Mutex
+		failed = map[string]error{}
+		wg     sync.WaitGroup
+	)
+
+	sem := make(chan struct{}, parallelism)
+
+	for _, fs := range resources {
+		fs := fs
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer close(done[fs.Id()])
+
+			for _, d := range deps[fs.Id()] {
+				<-done[d]
+
+				mu.Lock()
+				_, ok := failed[d]
+				mu.Unlock()
+
+				if ok {
+					mu.Lock()
+					failed[fs.Id()] = fmt.Errorf("skipped due to the failure of %q", d)
+					mu.Unlock()
+
+					return
+				}
+			}
+
+			sem <- struct{}{}
+			err := f(fs)
+			<-sem
+
+			if err != nil {
+				mu.Lock()
+				failed[fs.Id()] = err
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	var errs embeddedErrors
+
+	for _, fs := range resources {
+		if err, ok := failed[fs.Id()]; ok {
+			errs = append(errs, embeddedError{Key: fs.Id(), Err: err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package helmfile
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newEmbeddedResources(t *testing.T, needs map[string][]string, keys ...string) []*ResourceReadWriteEmbedded {
+	t.Helper()
+
+	var entries []map[string]interface{}
+
+	for _, k := range keys {
+		var ns []interface{}
+
+		for _, n := range needs[k] {
+			ns = append(ns, n)
+		}
+
+		entries = append(entries, map[string]interface{}{KeyEmbeddedKey: k, KeyEmbeddedNeeds: ns})
+	}
+
+	resources, err := keyEmbeddedReleaseSetResources(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resources
+}
+
+func TestRunEmbeddedOrder(t *testing.T) {
+	resources := newEmbeddedResources(t, map[string][]string{
+		"app": {"db", "cache"},
+		"db":  {"crds"},
+	}, "app", "db", "cache", "crds")
+
+	run := func(reverse bool) []string {
+		var (
+			mu    sync.Mutex
+			order []string
+		)
+
+		err := runEmbedded(resources, 4, reverse, func(fs *ResourceReadWriteEmbedded) error {
+			mu.Lock()
+			order = append(order, fs.Id())
+			mu.Unlock()
+
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return order
+	}
+
+	indexOf := func(order []string, k string) int {
+		for i, o := range order {
+			if o == k {
+				return i
+			}
+		}
+
+		t.Fatalf("%s not processed: %v", k, order)
+
+		return -1
+	}
+
+	order := run(false)
+
+	for _, dep := range [][2]string{{"crds", "db"}, {"db", "app"}, {"cache", "app"}} {
+		if indexOf(order, dep[0]) > indexOf(order, dep[1]) {
+			t.Errorf("expected %s to be processed before %s: %v", dep[0], dep[1], order)
+		}
+	}
+
+	order = run(true)
+
+	for _, dep := range [][2]string{{"app", "db"}, {"db", "crds"}, {"app", "cache"}} {
+		if indexOf(order, dep[0]) > indexOf(order, dep[1]) {
+			t.Errorf("expected %s to be destroyed before %s: %v", dep[0], dep[1], order)
+		}
+	}
+}
+
+func TestRunEmbeddedParallelism(t *testing.T) {
+	resources := newEmbeddedResources(t, nil, "a", "b", "c", "d", "e")
+
+	var (
+		mu               sync.Mutex
+		running, maxSeen int
+	)
+
+	err := runEmbedded(resources, 2, false, func(fs *ResourceReadWriteEmbedded) error {
+		mu.Lock()
+		running++
+		if running > maxSeen {
+			maxSeen = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if maxSeen > 2 {
+		t.Errorf("expected at most 2 concurrent runs, got %d", maxSeen)
+	}
+}
+
+func TestRunEmbeddedErrors(t *testing.T) {
+	resources := newEmbeddedResources(t, map[string][]string{
+		"app": {"db"},
+	}, "app", "db", "cache")
+
+	err := runEmbedded(resources, 3, false, func(fs *ResourceReadWriteEmbedded) error {
+		if fs.Id() == "db" {
+			return errors.New("helmfile apply failed")
+		}
+
+		return nil
+	})
+
+	var errs embeddedErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("expected embeddedErrors, got %v", err)
+	}
+
+	if len(errs) != 2 || errs[0].Key != "app" || errs[1].Key != "db" {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	if !strings.Contains(err.Error(), `embedded release set "db": helmfile apply failed`) {
+		t.Errorf("expected the error to name the failed entry: %v", err)
+	}
+
+	if !strings.Contains(errs[0].Err.Error(), `skipped due to the failure of "db"`) {
+		t.Errorf("expected app to be skipped: %v", errs[0].Err)
+	}
+}
+
+func TestValidateEmbeddedNeeds(t *testing.T) {
+	if err := validateEmbeddedNeeds(newEmbeddedResources(t, map[string][]string{"a": {"missing"}}, "a")); err == nil {
+		t.Errorf("expected an error for the unknown release set")
+	}
+
+	err := validateEmbeddedNeeds(newEmbeddedResources(t, map[string][]string{"a": {"b"}, "b": {"a"}}, "a", "b"))
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle") {
+		t.Errorf("expected a dependency cycle error, got %v", err)
+	}
+}
@@ -0,0 +1,237 @@
+package helmfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+)
+
+// helmPluginSources maps names of well-known helm plugins to their sources,
+// so that the user can install any of them by specifying only the version.
+var helmPluginSources = map[string]string{
+	"diff":     "https://github.com/databus23/helm-diff",
+	"secrets":  "https://github.com/jkroepke/helm-secrets",
+	"helm-git": "https://github.com/aslafy-z/helm-git",
+	"s3":       "https://github.com/hypnoglow/helm-s3",
+}
+
+// DefaultHelmDiffVersion is the version of helm-diff installed when helm plugins are managed by the provider
+// but the user specified neither helm_diff_version nor helm_plugins.diff.
+const DefaultHelmDiffVersion = "master"
+
+type helmPlugin struct {
+	// Name is the name of the plugin as shown in `helm plugin list`
+	Name string
+
+	// Source is the URL or the local path to the plugin that is passed to `helm plugin install`
+	Source string
+
+	// Version is the optional version of the plugin passed to `helm plugin install --version`
+	Version string
+}
+
+// getHelmPlugins returns the list of helm plugins to be installed for the release set, sorted by name.
+//
+// Plugins are installed only for helm installed by the provider, so that the provider never changes plugins on the host.
+// It returns nil for helm on the host, which is run with the plugins already installed on the host,
+// and fails when helm_plugins is set for it.
+func getHelmPlugins(fs *ReleaseSet) ([]helmPlugin, error) {
+	if !isolatesHelmPlugins(fs) {
+		if len(fs.HelmPlugins) > 0 {
+			var names []string
+			for name := range fs.HelmPlugins {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			return nil, fmt.Errorf("unable to install helm plugins %s: %s requires %s, so that plugins are installed into the provider-managed directory "+
+				"instead of the plugins directory of helm on the host. Install them on the host, or set %s and leave %s unset",
+				strings.Join(names, ", "), KeyHelmPlugins, KeyHelmVersion, KeyHelmVersion, KeyHelmBin)
+		}
+
+		return nil, nil
+	}
+
+	specs := map[string]string{}
+
+	for name, v := range fs.HelmPlugins {
+		specs[name] = fmt.Sprintf("%v", v)
+	}
+
+	// helmfile can't run without helm-diff. As helm installed by the provider is unable to see plugins installed outside of
+	// the provider-managed plugins directory, we always install helm-diff in addition to the user-specified ones.
+	if _, ok := specs["diff"]; !ok {
+		v := fs.HelmDiffVersion
+		if v == "" {
+			v = DefaultHelmDiffVersion
+		}
+
+		specs["diff"] = v
+	}
+
+	var plugins []helmPlugin
+
+	for name, spec := range specs {
+		p, err := parseHelmPlugin(name, spec)
+		if err != nil {
+			return nil, err
+		}
+
+		plugins = append(plugins, *p)
+	}
+
+	sort.Slice(plugins, func(i, j int) bool {
+		return plugins[i].Name < plugins[j].Name
+	})
+
+	return plugins, nil
+}
+
+// parseHelmPlugin parses the value of a helm_plugins entry, that is either a version of a well-known plugin
+// or a source URL or a local path of the plugin.
+func parseHelmPlugin(name, spec string) (*helmPlugin, error) {
+	if isHelmPluginSource(spec) {
+		return &helmPlugin{Name: name, Source: spec}, nil
+	}
+
+	source, ok := helmPluginSources[name]
+	if !ok {
+		var known []string
+		for k := range helmPluginSources {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+
+		return nil, fmt.Errorf("unable to determine the source of helm plugin %q: specify the URL or the local path of the plugin instead of the version %q, or use one of well-known plugins %s", name, spec, strings.Join(known, ", "))
+	}
+
+	return &helmPlugin{Name: name, Source: source, Version: spec}, nil
+}
+
+func isHelmPluginSource(spec string) bool {
+	return strings.Contains(spec, "://") ||
+		strings.HasPrefix(spec, "/") ||
+		strings.HasPrefix(spec, "./") ||
+		strings.HasPrefix(spec, "../")
+}
+
+// isolatesHelmPlugins returns true when helm is installed by the provider.
+// Plugins for that helm are installed into the provider-managed directory, isolated from the plugins installed on the host.
+// Otherwise the provider leaves plugins alone, so that helm keeps seeing the plugins the user has installed.
+func isolatesHelmPlugins(fs *ReleaseSet) bool {
+	return fs.HelmVersion != "" && !isLocalBinary(fs.HelmBin, DefaultHelmBinary)
+}
+
+// helmPluginsEnv returns environment variables to let helm find plugins installed under dataHome
+func helmPluginsEnv(dataHome string) []string {
+	return []string{
+		"XDG_DATA_HOME=" + dataHome,
+		"HELM_PLUGINS=" + filepath.Join(dataHome, "helm", "plugins"),
+	}
+}
+
+func newHelmCommand(helmBin string, env []string, args ...string) *exec.Cmd {
+	cmd := exec.Command(helmBin, args...)
+	cmd.Env = append(os.Environ(), env...)
+
+	return cmd
+}
+
+// listHelmPlugins returns installed helm plugins keyed by their names, whose values are versions.
+// env is the additional environment variables for helm to locate plugins, which is usually the result of helmPluginsEnv.
+func listHelmPlugins(helmBin string, env []string) (map[string]string, error) {
+	out, err := newHelmCommand(helmBin, env, "plugin", "list").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("running helm plugin list: %w\nCOMBINED OUTPUT:\n%s", err, string(out))
+	}
+
+	installed := map[string]string{}
+
+	s := bufio.NewScanner(strings.NewReader(string(out)))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] == "NAME" {
+			continue
+		}
+
+		installed[fields[0]] = fields[1]
+	}
+
+	return installed, nil
+}
+
+// installHelmPlugins installs helm plugins into dataHome.
+// A plugin that is already installed is reinstalled only when the installed version differs from the desired version.
+func installHelmPlugins(helmBin, dataHome string, plugins []helmPlugin) error {
+	if dataHome == "" {
+		return fmt.Errorf("[BUG] installing helm plugins without the provider-managed plugins directory")
+	}
+
+	if err := os.MkdirAll(filepath.Join(dataHome, "helm", "plugins"), 0755); err != nil {
+		return fmt.Errorf("creating helm plugins directory: %w", err)
+	}
+
+	env := helmPluginsEnv(dataHome)
+
+	installed, err := listHelmPlugins(helmBin, env)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range plugins {
+		if current, ok := installed[p.Name]; ok {
+			if !helmPluginNeedsUpgrade(current, p.Version) {
+				logf("Skipping installation of helm plugin %s: version %s is already installed", p.Name, current)
+
+				continue
+			}
+
+			logf("Uninstalling helm plugin %s %s to install %s", p.Name, current, p.Version)
+
+			if out, err := newHelmCommand(helmBin, env, "plugin", "uninstall", p.Name).CombinedOutput(); err != nil {
+				return fmt.Errorf("uninstalling helm plugin %s: %w\nCOMBINED OUTPUT:\n%s", p.Name, err, string(out))
+			}
+		}
+
+		args := []string{"plugin", "install", p.Source}
+		if p.Version != "" {
+			args = append(args, "--version", p.Version)
+		}
+
+		logf("Installing helm plugin %s from %s", p.Name, p.Source)
+
+		if out, err := newHelmCommand(helmBin, env, args...).CombinedOutput(); err != nil {
+			if !strings.HasPrefix(string(out), "Error: plugin already exists") {
+				return fmt.Errorf("installing helm plugin %s: %w\nCOMBINED OUTPUT:\n%s", p.Name, err, string(out))
+			}
+		}
+	}
+
+	return nil
+}
+
+// helmPluginNeedsUpgrade returns true only when both versions are semver and they differ.
+// A branch name like `master` or an unspecified version never triggers reinstallation.
+func helmPluginNeedsUpgrade(current, desired string) bool {
+	if desired == "" {
+		return false
+	}
+
+	d, err := semver.NewVersion(desired)
+	if err != nil {
+		return false
+	}
+
+	c, err := semver.NewVersion(current)
+	if err != nil {
+		return true
+	}
+
+	return !c.Equal(d)
+}
@@ -0,0 +1,127 @@
+package helmfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetHelmPlugins(t *testing.T) {
+	testcases := []struct {
+		name string
+		fs   ReleaseSet
+		want []helmPlugin
+		err  bool
+	}{
+		{
+			name: "unmanaged",
+			fs:   ReleaseSet{},
+			want: nil,
+		},
+		{
+			name: "helm-diff is installed along with helm",
+			fs:   ReleaseSet{HelmVersion: "3.2.1"},
+			want: []helmPlugin{
+				{Name: "diff", Source: "https://github.com/databus23/helm-diff", Version: "master"},
+			},
+		},
+		{
+			name: "well-known plugins and sources",
+			fs: ReleaseSet{
+				HelmVersion:     "3.2.1",
+				HelmDiffVersion: "v3.1.3",
+				HelmPlugins: map[string]interface{}{
+					"secrets":  "v3.4.0",
+					"helm-git": "https://github.com/aslafy-z/helm-git",
+				},
+			},
+			want: []helmPlugin{
+				{Name: "diff", Source: "https://github.com/databus23/helm-diff", Version: "v3.1.3"},
+				{Name: "helm-git", Source: "https://github.com/aslafy-z/helm-git"},
+				{Name: "secrets", Source: "https://github.com/jkroepke/helm-secrets", Version: "v3.4.0"},
+			},
+		},
+		{
+			name: "helm on the host keeps using its own helm-diff",
+			fs: ReleaseSet{
+				HelmDiffVersion: "v3.1.3",
+			},
+			want: nil,
+		},
+		{
+			name: "helm on the host never gets plugins installed",
+			fs: ReleaseSet{
+				HelmPlugins: map[string]interface{}{
+					"secrets": "v3.4.0",
+				},
+			},
+			err: true,
+		},
+		{
+			name: "local helm with helm_version never gets plugins installed",
+			fs: ReleaseSet{
+				HelmBin:     "/usr/local/bin/helm",
+				HelmVersion: ">= 3.0.0",
+				HelmPlugins: map[string]interface{}{
+					"secrets": "v3.4.0",
+				},
+			},
+			err: true,
+		},
+		{
+			name: "helm_plugins.diff takes precedence over helm_diff_version",
+			fs: ReleaseSet{
+				HelmVersion:     "3.2.1",
+				HelmDiffVersion: "v3.1.3",
+				HelmPlugins: map[string]interface{}{
+					"diff": "v3.1.2",
+				},
+			},
+			want: []helmPlugin{
+				{Name: "diff", Source: "https://github.com/databus23/helm-diff", Version: "v3.1.2"},
+			},
+		},
+		{
+			name: "unknown plugin without source",
+			fs: ReleaseSet{
+				HelmVersion: "3.2.1",
+				HelmPlugins: map[string]interface{}{
+					"unknown": "v1.0.0",
+				},
+			},
+			err: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := getHelmPlugins(&tc.fs)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected result: want %+v, got %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestHelmPluginsEnv(t *testing.T) {
+	want := []string{"XDG_DATA_HOME=/cache/Library", "HELM_PLUGINS=/cache/Library/helm/plugins"}
+	if env := helmPluginsEnv("/cache/Library"); !reflect.DeepEqual(env, want) {
+		t.Errorf("unexpected environment variables: want %v, got %v", want, env)
+	}
+}
+
+func TestInstallHelmPlugins_RequiresDataHome(t *testing.T) {
+	// Plugins must never be installed into the plugins directory of helm on the host
+	err := installHelmPlugins("/nonexistent/helm", "", []helmPlugin{{Name: "secrets", Source: "https://github.com/jkroepke/helm-secrets"}})
+	if err == nil {
+		t.Fatal("expected an error without the provider-managed plugins directory")
+	}
+}
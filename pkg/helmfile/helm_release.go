@@ -0,0 +1,199 @@
+package helmfile
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// helmRelease is an item in the output of `helm list --output json`
+type helmRelease struct {
+	Name       string `json:"name"`
+	Namespace  string `json:"namespace"`
+	Revision   string `json:"revision"`
+	Updated    string `json:"updated"`
+	Status     string `json:"status"`
+	Chart      string `json:"chart"`
+	AppVersion string `json:"app_version"`
+}
+
+// helmClient runs helm against a specific kube context to query releases
+type helmClient struct {
+	Bin         string
+	Env         []string
+	Kubecontext string
+
+	// ReleaseSet is the release set whose logger receives durations of helm commands
+	ReleaseSet *ReleaseSet
+}
+
+func (c *helmClient) args(namespace string, args ...string) []string {
+	if namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+
+	if c.Kubecontext != "" {
+		args = append(args, "--kube-context", c.Kubecontext)
+	}
+
+	return args
+}
+
+func (c *helmClient) run(namespace string, args ...string) ([]byte, error) {
+	bin := c.Bin
+	if bin == "" {
+		bin = DefaultHelmBinary
+	}
+
+	args = c.args(namespace, args...)
+
+	cmd := newHelmCommand(bin, c.Env, args...)
+
+	var sp *span
+
+	if c.ReleaseSet != nil {
+		sp = c.ReleaseSet.startCommandSpan(cmd.Args)
+	}
+
+	start := time.Now()
+	out, err := cmd.Output()
+
+	if c.ReleaseSet != nil {
+		c.ReleaseSet.logCommand(cmd.Args, time.Since(start), err)
+	}
+
+	sp.finish(err)
+
+	if err != nil {
+		return nil, fmt.Errorf("running %s %s: %w", bin, strings.Join(args, " "), err)
+	}
+
+	return out, nil
+}
+
+// getRelease returns the release named `name` in the namespace, or nil when the release doesn't exist
+func (c *helmClient) getRelease(namespace, name string) (*helmRelease, error) {
+	out, err := c.run(namespace, "list", "--output", "json", "--all", "--filter", "^"+regexp.QuoteMeta(name)+"$")
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []helmRelease
+
+	if err := json.Unmarshal(out, &releases); err != nil {
+		return nil, fmt.Errorf("parsing helm list output: %w", err)
+	}
+
+	for _, r := range releases {
+		if r.Name == name {
+			return &r, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// getValues returns user-supplied values of the release
+func (c *helmClient) getValues(namespace, name string) (map[string]interface{}, error) {
+	out, err := c.run(namespace, "get", "values", name, "--output", "json")
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+
+	if err := json.Unmarshal(out, &values); err != nil {
+		return nil, fmt.Errorf("parsing helm get values output: %w", err)
+	}
+
+	return values, nil
+}
+
+// getManifest returns the manifest rendered for the latest revision of the release
+func (c *helmClient) getManifest(namespace, name string) (string, error) {
+	out, err := c.run(namespace, "get", "manifest", name)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+var chartVersionSuffix = regexp.MustCompile(`^(.+)-(v?[0-9]+\.[0-9]+\.[0-9]+.*)$`)
+
+// splitChart splits the chart shown in `helm list` like `podinfo-4.0.6` into the name and the version
+func splitChart(chart string) (string, string) {
+	m := chartVersionSuffix.FindStringSubmatch(chart)
+	if m == nil {
+		return chart, ""
+	}
+
+	return m[1], m[2]
+}
+
+// setReleaseStatus fills computed attributes like revision and status with the live release obtained from helm.
+// All the attributes are emptied when the release doesn't exist, e.g. when it has `installed = false`.
+func setReleaseStatus(fs *ReleaseSet, r *Release, d ResourceReadWrite) error {
+	kubeconfig, err := getKubeconfig(fs)
+	if err != nil {
+		return err
+	}
+
+	bins, err := prepareBinaries(fs)
+	if err != nil {
+		return err
+	}
+
+	helm := &helmClient{
+		Bin:         bins.Helm,
+		Env:         append(append([]string{}, bins.Env...), "KUBECONFIG="+*kubeconfig),
+		Kubecontext: r.Kubecontext,
+		ReleaseSet:  fs,
+	}
+
+	rel, err := helm.getRelease(r.Namespace, r.Name)
+	if err != nil {
+		return fmt.Errorf("getting release status: %w", err)
+	}
+
+	if rel == nil {
+		for _, k := range releaseStatusKeys {
+			if k == KeyRevision {
+				d.Set(k, 0)
+			} else {
+				d.Set(k, "")
+			}
+		}
+
+		return nil
+	}
+
+	revision, err := strconv.Atoi(rel.Revision)
+	if err != nil {
+		return fmt.Errorf("parsing revision %q: %w", rel.Revision, err)
+	}
+
+	manifest, err := helm.getManifest(r.Namespace, r.Name)
+	if err != nil {
+		return fmt.Errorf("getting release manifest: %w", err)
+	}
+
+	if v := d.Get(KeyHashManifest); v != nil && v.(bool) {
+		manifest = fmt.Sprintf("%x", sha256.Sum256([]byte(manifest)))
+	}
+
+	_, chartVersion := splitChart(rel.Chart)
+
+	d.Set(KeyRevision, revision)
+	d.Set(KeyStatus, rel.Status)
+	d.Set(KeyAppVersion, rel.AppVersion)
+	d.Set(KeyChartVersion, chartVersion)
+	d.Set(KeyLastDeployed, rel.Updated)
+	d.Set(KeyManifest, manifest)
+
+	return nil
+}
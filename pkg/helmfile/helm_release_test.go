@@ -0,0 +1,149 @@
+package helmfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+func TestSplitChart(t *testing.T) {
+	testcases := []struct {
+		chart, name, version string
+	}{
+		{"podinfo-4.0.6", "podinfo", "4.0.6"},
+		{"cert-manager-v1.2.0", "cert-manager", "v1.2.0"},
+		{"my-chart-1.0.0-beta.1", "my-chart", "1.0.0-beta.1"},
+		{"noversion", "noversion", ""},
+	}
+
+	for _, tc := range testcases {
+		name, version := splitChart(tc.chart)
+		if name != tc.name || version != tc.version {
+			t.Errorf("unexpected result for %s: want (%s, %s), got (%s, %s)", tc.chart, tc.name, tc.version, name, version)
+		}
+	}
+}
+
+func setenv(t *testing.T, key, value string) {
+	t.Helper()
+
+	prev, ok := os.LookupEnv(key)
+
+	if err := os.Setenv(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, prev)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestImportRelease(t *testing.T) {
+	dir := t.TempDir()
+
+	// The fake helm fails unless it's run with the kubeconfig given to the import
+	script := `#!/bin/sh
+[ "$KUBECONFIG" = ./kubeconfig ] || exit 1
+case "$*" in
+list*) echo '[{"name":"myapp","namespace":"default","chart":"podinfo-4.0.6"}]' ;;
+get*) echo '{"replicaCount":2}' ;;
+esac
+`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "helm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	setenv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	newData := func() *schema.ResourceData {
+		d := resourceHelmfileRelease().TestResourceData()
+		d.SetId("mycluster/default/myapp")
+
+		return d
+	}
+
+	setenv(t, "KUBECONFIG", "")
+
+	if _, err := ImportRelease(newData()); err == nil {
+		t.Fatal("expected import to fail without KUBECONFIG")
+	}
+
+	setenv(t, "KUBECONFIG", "./kubeconfig")
+
+	d, err := ImportRelease(newData())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for k, want := range map[string]string{
+		KeyKubeconfig:  "./kubeconfig",
+		KeyKubecontext: "mycluster",
+		KeyNamespace:   "default",
+		KeyName:        "myapp",
+		KeyChart:       "podinfo",
+		KeyVersion:     "4.0.6",
+	} {
+		if got := d.Get(k).(string); got != want {
+			t.Errorf("unexpected %s: want %q, got %q", k, want, got)
+		}
+	}
+}
+
+func TestManifestIsProtected(t *testing.T) {
+	s := resourceHelmfileRelease().Schema
+
+	if !s[KeyManifest].Sensitive {
+		t.Errorf("expected %s to be sensitive", KeyManifest)
+	}
+
+	if s[KeyHashManifest].Default != true {
+		t.Errorf("expected %s to default to true", KeyHashManifest)
+	}
+}
+
+func TestUpdateRelease_StatusError(t *testing.T) {
+	dir := t.TempDir()
+
+	// The fake helm fails to get the status of the release
+	scripts := map[string]string{
+		"helmfile": "#!/bin/sh\necho helmfile version v0.139.0\n",
+		"helm":     "#!/bin/sh\nexit 1\n",
+	}
+
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	setenv(t, "PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	d := resourceHelmfileRelease().TestResourceData()
+	d.SetId("myapp")
+
+	for k, v := range map[string]interface{}{
+		KeyBin:              filepath.Join(dir, "helmfile"),
+		KeyName:             "myapp",
+		KeyNamespace:        "default",
+		KeyChart:            "sp/podinfo",
+		KeyKubeconfig:       filepath.Join(dir, "kubeconfig"),
+		KeyWorkingDirectory: dir,
+	} {
+		if err := d.Set(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is applied without the planned diff, so that only reading the status fails
+	if err := resourceHelmfileReleaseUpdate(d, nil); err != nil {
+		t.Errorf("expected the applied release not to fail on the status error: %v", err)
+	}
+}
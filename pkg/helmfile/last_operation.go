@@ -0,0 +1,106 @@
+package helmfile
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+)
+
+const KeyLastOperation = "last_operation"
+
+// Keys of the attributes in the last_operation block
+const (
+	KeyLastOperationOperation       = "operation"
+	KeyLastOperationCommand         = "command"
+	KeyLastOperationHelmfileVersion = "helmfile_version"
+	KeyLastOperationHelmVersion     = "helm_version"
+	KeyLastOperationHelmDiffVersion = "helm_diff_version"
+	KeyLastOperationStartTime       = "start_time"
+	KeyLastOperationEndTime         = "end_time"
+	KeyLastOperationDurationMS      = "duration_ms"
+	KeyLastOperationExitStatus      = "exit_status"
+	KeyLastOperationDiffSHA256      = "diff_sha256"
+)
+
+// lastOperationSchema is the schema for the computed block that records the last helmfile command
+// that changed the cluster, so that it can be read from the Terraform state
+var lastOperationSchema = &schema.Schema{
+	Type:     schema.TypeList,
+	Computed: true,
+	Elem: &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			KeyLastOperationOperation: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationCommand: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationHelmfileVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationHelmVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationHelmDiffVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationStartTime: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationEndTime: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastOperationDurationMS: {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			KeyLastOperationExitStatus: {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			KeyLastOperationDiffSHA256: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+		},
+	},
+}
+
+// setLastOperation records the command to the last_operation block of the resource.
+// Versions are the resolved ones recorded on the resource, which are verified to match binaries actually used.
+func setLastOperation(d ResourceReadWrite, r auditRecord) error {
+	op := map[string]interface{}{
+		KeyLastOperationOperation:       r.Operation,
+		KeyLastOperationCommand:         strings.Join(r.Args, " "),
+		KeyLastOperationHelmfileVersion: getString(d, KeyResolvedHelmfileVersion),
+		KeyLastOperationHelmVersion:     getString(d, KeyResolvedHelmVersion),
+		KeyLastOperationHelmDiffVersion: getString(d, KeyResolvedHelmDiffVersion),
+		KeyLastOperationStartTime:       r.Time,
+		KeyLastOperationEndTime:         r.EndTime,
+		KeyLastOperationDurationMS:      int(r.DurationMS),
+		KeyLastOperationExitStatus:      r.ExitCode,
+		KeyLastOperationDiffSHA256:      r.DiffSHA256,
+	}
+
+	return d.Set(KeyLastOperation, []interface{}{op})
+}
+
+func getString(d ResourceRead, key string) string {
+	if v := d.Get(key); v != nil {
+		return v.(string)
+	}
+
+	return ""
+}
+
+func formatOperationTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
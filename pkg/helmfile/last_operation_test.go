@@ -0,0 +1,50 @@
+package helmfile
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+func TestRunMutatingCommandSetsLastOperation(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig: "kubeconfig",
+	})
+	d.SetId("abc")
+
+	d.Set(KeyDiffOutput, "Comparing release=podinfo, chart=sp/podinfo")
+	d.Set(KeyResolvedHelmfileVersion, "0.138.7")
+	d.Set(KeyResolvedHelmVersion, "3.5.4")
+
+	fs := &ReleaseSet{}
+
+	cmd := exec.Command("sh", "-c", "exit 3", "apply")
+
+	if _, err := runMutatingCommand(&sdk.Context{}, fs, d, cmd); err == nil {
+		t.Fatal("expected the command to fail")
+	}
+
+	if n := d.Get(KeyLastOperation + ".#").(int); n != 1 {
+		t.Fatalf("expected a last_operation block, got %d", n)
+	}
+
+	op := d.Get(KeyLastOperation + ".0").(map[string]interface{})
+
+	if op[KeyLastOperationExitStatus] != 3 {
+		t.Errorf("unexpected exit status: %v", op[KeyLastOperationExitStatus])
+	}
+
+	if op[KeyLastOperationHelmfileVersion] != "0.138.7" || op[KeyLastOperationHelmVersion] != "3.5.4" {
+		t.Errorf("unexpected versions: %v", op)
+	}
+
+	if op[KeyLastOperationCommand] != "sh -c exit 3 apply" || op[KeyLastOperationOperation] != "apply" {
+		t.Errorf("unexpected command: %v", op)
+	}
+
+	if op[KeyLastOperationDiffSHA256] == "" || op[KeyLastOperationStartTime] == "" || op[KeyLastOperationEndTime] == "" {
+		t.Errorf("missing diff hash or times: %v", op)
+	}
+}
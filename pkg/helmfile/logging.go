@@ -2,20 +2,282 @@ package helmfile
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+const (
+	KeyLogLevel  = "log_level"
+	KeyLogFormat = "log_format"
+)
+
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
 )
 
+// Operations that log lines are correlated by
+const (
+	OperationPlan   = "plan"
+	OperationCreate = "create"
+	OperationRead   = "read"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+var logLevels = []string{LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError}
+
+var logFormats = []string{LogFormatText, LogFormatJSON}
+
+var logConfig = struct {
+	sync.RWMutex
+
+	level  int
+	format string
+}{
+	format: LogFormatText,
+}
+
+// configureLogging sets the minimum level of log lines to be written and the format of them
+func configureLogging(level, format string) error {
+	l := logLevelIndex(level)
+	if l < 0 {
+		return fmt.Errorf("unsupported log level %q: it must be one of %s", level, strings.Join(logLevels, ", "))
+	}
+
+	if format != LogFormatText && format != LogFormatJSON {
+		return fmt.Errorf("unsupported log format %q: it must be one of %s", format, strings.Join(logFormats, ", "))
+	}
+
+	logConfig.Lock()
+	defer logConfig.Unlock()
+
+	logConfig.level = l
+	logConfig.format = format
+
+	return nil
+}
+
+func logLevelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// logField is a key-value pair attached to a log line
+type logField struct {
+	Key   string
+	Value interface{}
+}
+
+// operationLogger writes structured log lines, each of which carries fields identifying
+// the resource and the operation it was emitted for
+type operationLogger struct {
+	fields []logField
+}
+
+var rootLogger = &operationLogger{}
+
+// newOperationLogger returns the logger for an operation on a resource.
+// All the lines written by the logger share the newly generated correlation ID.
+func newOperationLogger(resourceType, id, operation string) *operationLogger {
+	return &operationLogger{
+		fields: []logField{
+			{Key: "correlation_id", Value: xid.New().String()},
+			{Key: "resource", Value: resourceType},
+			{Key: "id", Value: id},
+			{Key: "operation", Value: operation},
+		},
+	}
+}
+
+// with returns the child logger that adds the field to every line
+func (l *operationLogger) with(key string, value interface{}) *operationLogger {
+	fields := append(append([]logField{}, l.fields...), logField{Key: key, Value: value})
+
+	return &operationLogger{fields: fields}
+}
+
+// field returns the value of the field, or an empty string when the logger doesn't have it
+func (l *operationLogger) field(key string) string {
+	for _, f := range l.fields {
+		if f.Key == key {
+			return fmt.Sprintf("%v", f.Value)
+		}
+	}
+
+	return ""
+}
+
+// Printf writes the message at the level specified by its prefix like `[INFO] `, or at the debug level without the prefix.
+func (l *operationLogger) Printf(format string, args ...interface{}) {
+	level, msg := parseLogLevel(fmt.Sprintf(format, args...))
+
+	l.log(level, msg)
+}
+
+func (l *operationLogger) log(level, msg string, fields ...logField) {
+	logConfig.RLock()
+	minLevel, format := logConfig.level, logConfig.format
+	logConfig.RUnlock()
+
+	if logLevelIndex(level) < minLevel {
+		return
+	}
+
+	all := append(append([]logField{
+		{Key: "pid", Value: os.Getpid()},
+		{Key: "ppid", Value: os.Getppid()},
+	}, l.fields...), fields...)
+
+	// Terraform filters plugin logs by the level in the prefix, according to TF_LOG
+	prefix := "[" + strings.ToUpper(level) + "] "
+
+	if format == LogFormatJSON {
+		m := map[string]interface{}{
+			"level": level,
+			"msg":   msg,
+		}
+
+		for _, f := range all {
+			m[f.Key] = f.Value
+		}
+
+		j, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("%shelmfile-provider: %s (failed encoding log fields: %v)", prefix, msg, err)
+
+			return
+		}
+
+		log.Printf("%s%s", prefix, string(j))
+
+		return
+	}
+
+	var kvs []string
+
+	for _, f := range all {
+		kvs = append(kvs, f.Key+"="+formatLogValue(f.Value))
+	}
+
+	log.Printf("%shelmfile-provider: %s %s", prefix, msg, strings.Join(kvs, " "))
+}
+
+func formatLogValue(v interface{}) string {
+	var s string
+
+	switch t := v.(type) {
+	case string:
+		s = t
+	case fmt.Stringer:
+		s = t.String()
+	case int, int64, float64, bool:
+		s = fmt.Sprintf("%v", t)
+	default:
+		j, err := json.Marshal(t)
+		if err != nil {
+			s = fmt.Sprintf("%v", t)
+		} else {
+			s = string(j)
+		}
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+
+	return s
+}
+
+// parseLogLevel extracts the level from the message prefixed with e.g. `[DEBUG] ` as used by log lines consumed by Terraform.
+func parseLogLevel(msg string) (string, string) {
+	for _, l := range logLevels {
+		prefix := "[" + strings.ToUpper(l) + "] "
+
+		if strings.HasPrefix(msg, prefix) {
+			return l, strings.TrimPrefix(msg, prefix)
+		}
+	}
+
+	return LogLevelDebug, msg
+}
+
 func dump(s string, entries []map[string]interface{}) {
-	j, _ := json.Marshal(entries)
-	if j == nil {
-		j = []byte{}
+	if entries == nil {
+		entries = []map[string]interface{}{}
 	}
-	log.Printf("DUMP[%s]: %s", s, string(j))
+
+	rootLogger.log(LogLevelDebug, "dump", logField{Key: "dump", Value: s}, logField{Key: "entries", Value: entries})
 }
 
 func logf(msg string, args ...interface{}) {
-	ppid := os.Getppid()
-	pid := os.Getpid()
-	log.Printf("[DEBUG] helmfile-provider(pid=%d,ppid=%d): "+msg, append([]interface{}{pid, ppid}, args...)...)
+	rootLogger.Printf(msg, args...)
+}
+
+// Logger receives log messages emitted while running helmfile for a release set.
+// *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// logf writes the message to the logger of the release set, or to the standard logger when it's not set.
+func (fs *ReleaseSet) logf(msg string, args ...interface{}) {
+	if fs.Logger == nil {
+		logf(msg, args...)
+
+		return
+	}
+
+	fs.Logger.Printf(msg, args...)
+}
+
+// logFields writes the message along with the fields.
+// Fields are appended to the message as `key=value` pairs when the logger of the release set isn't structured.
+func (fs *ReleaseSet) logFields(level, msg string, fields ...logField) {
+	switch l := fs.Logger.(type) {
+	case *operationLogger:
+		l.log(level, msg, fields...)
+	case nil:
+		rootLogger.log(level, msg, fields...)
+	default:
+		var kvs []string
+
+		for _, f := range fields {
+			kvs = append(kvs, f.Key+"="+formatLogValue(f.Value))
+		}
+
+		l.Printf("[%s] %s %s", strings.ToUpper(level), msg, strings.Join(kvs, " "))
+	}
+}
+
+// logCommand logs the duration and the result of the child process
+func (fs *ReleaseSet) logCommand(args []string, duration time.Duration, err error) {
+	fields := []logField{
+		{Key: "command", Value: strings.Join(args, " ")},
+		{Key: "duration_ms", Value: duration.Milliseconds()},
+	}
+
+	if err != nil {
+		fs.logFields(LogLevelError, "Command failed", append(fields, logField{Key: "error", Value: err.Error()})...)
+
+		return
+	}
+
+	fs.logFields(LogLevelDebug, "Command finished", fields...)
 }
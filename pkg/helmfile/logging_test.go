@@ -0,0 +1,109 @@
+package helmfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func captureLog(t *testing.T, level, format string, f func()) string {
+	t.Helper()
+
+	if err := configureLogging(level, format); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	w, flags := log.Writer(), log.Flags()
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+
+	defer func() {
+		log.SetOutput(w)
+		log.SetFlags(flags)
+
+		if err := configureLogging(LogLevelDebug, LogFormatText); err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	f()
+
+	return buf.String()
+}
+
+func TestOperationLoggerJSON(t *testing.T) {
+	out := captureLog(t, LogLevelDebug, LogFormatJSON, func() {
+		l := newOperationLogger("helmfile_release_set", "abc", OperationCreate).with("key", "frontend")
+		l.Printf("[INFO] Running %s", "helmfile")
+	})
+
+	if !strings.HasPrefix(out, "[INFO] {") {
+		t.Fatalf("expected the line to be prefixed with the level for Terraform, got %q", out)
+	}
+
+	var m map[string]interface{}
+
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(out), "[INFO] ")), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"level":     "info",
+		"msg":       "Running helmfile",
+		"resource":  "helmfile_release_set",
+		"id":        "abc",
+		"operation": "create",
+		"key":       "frontend",
+	} {
+		if m[k] != v {
+			t.Errorf("unexpected %s: want %v, got %v", k, v, m[k])
+		}
+	}
+
+	if m["correlation_id"] == "" || m["correlation_id"] == nil {
+		t.Errorf("expected correlation_id, got %v", m)
+	}
+}
+
+func TestOperationLoggerLevel(t *testing.T) {
+	out := captureLog(t, LogLevelWarn, LogFormatText, func() {
+		l := newOperationLogger("helmfile_release", "myapp", OperationPlan)
+		l.Printf("[DEBUG] Detecting changes")
+		l.Printf("unprefixed messages are at the debug level")
+		l.Printf("[WARN] Something went wrong")
+	})
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the warn line to be written, got %q", out)
+	}
+
+	if !strings.HasPrefix(lines[0], "[WARN] helmfile-provider: Something went wrong ") || !strings.Contains(lines[0], " operation=plan") {
+		t.Errorf("unexpected line: %q", lines[0])
+	}
+}
+
+func TestLogCommand(t *testing.T) {
+	out := captureLog(t, LogLevelDebug, LogFormatText, func() {
+		fs := &ReleaseSet{Logger: newOperationLogger("helmfile_release_set", "abc", OperationUpdate)}
+		fs.logCommand([]string{"helmfile", "apply"}, 1500000000, nil)
+	})
+
+	if !strings.Contains(out, `command="helmfile apply"`) || !strings.Contains(out, "duration_ms=1500") {
+		t.Errorf("unexpected line: %q", out)
+	}
+}
+
+func TestConfigureLoggingValidation(t *testing.T) {
+	if err := configureLogging("verbose", LogFormatText); err == nil {
+		t.Errorf("expected an error for the unknown level")
+	}
+
+	if err := configureLogging(LogLevelInfo, "xml"); err == nil {
+		t.Errorf("expected an error for the unknown format")
+	}
+}
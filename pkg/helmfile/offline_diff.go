@@ -0,0 +1,168 @@
+package helmfile
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+var templatingRelease = regexp.MustCompile(`^Templating release=([^,]+), chart=(.+)$`)
+
+// runOfflineDiff computes the diff for a cluster that has none of the releases installed, without accessing the cluster.
+//
+// It renders manifests with `helmfile template` and formats them like the helmfile-diff output against an empty cluster,
+// so that the plan shows every resource to be installed on a cluster that is yet to be created.
+func runOfflineDiff(ctx *sdk.Context, fs *ReleaseSet) (*State, error) {
+	// Rendering releases one by one keeps log lines like `Templating release=...` next to manifests of the release
+	args := []string{
+		"template",
+		"--concurrency", "1",
+	}
+
+	for k, v := range fs.ReleasesValues {
+		args = append(args, "--set", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	cmd, err := newCommandWithoutCluster(fs, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fs.TmpHelmFilePath)
+
+	//obtain exclusive lock
+	mutexKV.Lock(fs.WorkingDirectory)
+	defer mutexKV.Unlock(fs.WorkingDirectory)
+
+	// The whole output is needed, as the `Templating release=...` header at the beginning of each release is parsed
+	st, err := runCommandWithFullOutput(ctx, fs, cmd, false)
+	if err != nil {
+		return nil, fmt.Errorf("running helmfile template: %w", err)
+	}
+
+	return &State{Output: formatOfflineDiff(st.Output)}, nil
+}
+
+// formatOfflineDiff converts `helmfile template` output into the helmfile-diff output that adds all the resources.
+// It returns an empty string when there are no resources to be added.
+func formatOfflineDiff(templateOutput string) string {
+	var (
+		buf     strings.Builder
+		doc     []string
+		release bool
+		changes bool
+	)
+
+	flush := func() {
+		if release {
+			if m := parseManifestHeader(doc); m != nil {
+				fmt.Fprintf(&buf, "%s, %s, %s (%s) has been added:\n", m.Namespace, m.Name, m.Kind, m.APIGroup)
+
+				for _, l := range doc {
+					fmt.Fprintf(&buf, "+ %s\n", l)
+				}
+
+				buf.WriteString("\n")
+
+				changes = true
+			}
+		}
+
+		doc = nil
+	}
+
+	s := bufio.NewScanner(strings.NewReader(templateOutput))
+	s.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	for s.Scan() {
+		l := s.Text()
+
+		if m := templatingRelease.FindStringSubmatch(l); m != nil {
+			flush()
+
+			fmt.Fprintf(&buf, "Comparing release=%s, chart=%s\n", m[1], m[2])
+
+			release = true
+
+			continue
+		}
+
+		if l == "---" {
+			flush()
+
+			continue
+		}
+
+		doc = append(doc, l)
+	}
+
+	flush()
+
+	if !changes {
+		return ""
+	}
+
+	return buf.String()
+}
+
+// parseManifestHeader reads the kind, the API group, the name and the namespace of the Kubernetes resource
+// from the lines of a rendered YAML document. It returns nil when the document isn't a Kubernetes resource.
+func parseManifestHeader(lines []string) *ResourceDiff {
+	var (
+		r          ResourceDiff
+		apiVersion string
+		inMetadata bool
+	)
+
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" || strings.HasPrefix(strings.TrimSpace(l), "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(l, " ") {
+			inMetadata = false
+
+			switch k, v := splitYAMLField(l); k {
+			case "apiVersion":
+				apiVersion = v
+			case "kind":
+				r.Kind = v
+			case "metadata":
+				inMetadata = true
+			}
+
+			continue
+		}
+
+		// Only direct children of metadata, indented with 2 spaces as helm charts conventionally do, are read
+		if inMetadata && strings.HasPrefix(l, "  ") && !strings.HasPrefix(l, "   ") {
+			switch k, v := splitYAMLField(strings.TrimSpace(l)); k {
+			case "name":
+				r.Name = v
+			case "namespace":
+				r.Namespace = v
+			}
+		}
+	}
+
+	if r.Kind == "" || apiVersion == "" {
+		return nil
+	}
+
+	r.APIGroup = strings.SplitN(apiVersion, "/", 2)[0]
+	r.Change = ResourceAdded
+
+	return &r
+}
+
+func splitYAMLField(l string) (string, string) {
+	kv := strings.SplitN(l, ":", 2)
+	if len(kv) != 2 {
+		return "", ""
+	}
+
+	return kv[0], strings.Trim(strings.TrimSpace(kv[1]), `"'`)
+}
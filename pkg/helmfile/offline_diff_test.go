@@ -0,0 +1,141 @@
+package helmfile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+func TestFormatOfflineDiff(t *testing.T) {
+	templateOutput := `Adding repo sp https://stefanprodan.github.io/podinfo
+Templating release=podinfo, chart=sp/podinfo
+---
+# Source: podinfo/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: podinfo
+  labels:
+    name: podinfo
+spec:
+  type: ClusterIP
+---
+# Source: podinfo/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: "podinfo"
+  namespace: podinfo
+spec:
+  replicas: 1
+`
+
+	want := `Comparing release=podinfo, chart=sp/podinfo
+, podinfo, Service (v1) has been added:
++ # Source: podinfo/templates/service.yaml
++ apiVersion: v1
++ kind: Service
++ metadata:
++   name: podinfo
++   labels:
++     name: podinfo
++ spec:
++   type: ClusterIP
+
+podinfo, podinfo, Deployment (apps) has been added:
++ # Source: podinfo/templates/deployment.yaml
++ apiVersion: apps/v1
++ kind: Deployment
++ metadata:
++   name: "podinfo"
++   namespace: podinfo
++ spec:
++   replicas: 1
+
+`
+
+	got := formatOfflineDiff(templateOutput)
+	if got != want {
+		t.Fatalf("unexpected diff:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+
+	releases := ParseDiffOutput(got)
+	if len(releases) != 1 || len(releases[0].Resources) != 2 {
+		t.Errorf("expected the offline diff to be parsed into 2 resources in 1 release, got %+v", releases)
+	}
+
+	if got := formatOfflineDiff("Templating release=empty, chart=./empty\n"); got != "" {
+		t.Errorf("expected no diff for a release without resources, got %q", got)
+	}
+}
+
+func TestDiffReleaseSet_DryRunWithoutKubeconfig(t *testing.T) {
+	dir := t.TempDir()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The diff file is written under .terraform in the current directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		os.Chdir(wd)
+	})
+
+	setenv(t, "KUBECONFIG", "")
+
+	// The template output is far larger than the 8KB that sdk.Context.Run keeps
+	var manifests strings.Builder
+
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&manifests, "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: config-%d\n  namespace: default\ndata:\n  key: value\n", i)
+	}
+
+	scripts := map[string]string{
+		"helmfile": "#!/bin/sh\n[ -z \"$KUBECONFIG\" ] || exit 1\ncase \"$*\" in\n" +
+			"*--version*|*\" version\"*) echo helmfile version v0.139.0 ;;\n" +
+			"*template*) echo 'Templating release=big, chart=./big' >&2; cat <<'EOF'\n" + manifests.String() + "EOF\n;;\n" +
+			"*build*) echo 'releases: []' ;;\n" +
+			"esac\n",
+		"helm": "#!/bin/sh\ncase \"$*\" in\n*version*) echo v3.5.4+g1b5edb6 ;;\n*plugin*) printf 'NAME VERSION DESCRIPTION\\ndiff 3.1.3 diff\\n' ;;\nesac\n",
+	}
+
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := &ReleaseSet{
+		Bin:              filepath.Join(dir, "helmfile"),
+		HelmBin:          filepath.Join(dir, "helm"),
+		Content:          "releases: []\n",
+		WorkingDirectory: dir,
+	}
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{})
+
+	diff, err := DiffReleaseSet(&sdk.Context{}, fs, d, WithDiffConfig(DiffConfig{DryRun: true, MaxDiffOutputLen: 1 << 20}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	releases := ParseDiffOutput(diff)
+	if len(releases) != 1 || len(releases[0].Resources) != 200 {
+		t.Fatalf("expected 200 resources to be added in 1 release, got %+v", releases)
+	}
+
+	if r := releases[0].Resources[0]; r.Name != "config-0" || r.Change != ResourceAdded {
+		t.Errorf("unexpected first resource: %+v", r)
+	}
+}
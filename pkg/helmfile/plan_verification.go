@@ -0,0 +1,200 @@
+package helmfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+// KeyVerifyPlanOnApply is the key of the attribute to re-run helmfile-diff right before apply
+// and stop applying when the cluster has changed since the plan
+const KeyVerifyPlanOnApply = "verify_plan_on_apply"
+
+// diffSnippedNotice is included in diff_output when the diff is longer than max_diff_output_len
+const diffSnippedNotice = "helmfile-diff output was too long, and therefore snipped."
+
+// Width of each column in the side-by-side explanation of the mismatch
+const sideBySideColumnWidth = 60
+
+// plannedDiff returns the diff computed on plan.
+// The full diff cached in the diff file is preferred over diff_output, that may have been snipped.
+func plannedDiff(ctx *sdk.Context, fs *ReleaseSet, d ResourceRead) string {
+	if diff, err := readDiffFile(ctx, fs); err == nil && diff != "" {
+		return diff
+	}
+
+	return getString(d, KeyDiffOutput)
+}
+
+// verifyPlannedDiff returns an error explaining the difference when the live diff doesn't match the planned one.
+// plannedSHA256 is used to compare the diffs when the planned diff was snipped and therefore can't be compared line by line.
+func verifyPlannedDiff(planned, live, plannedSHA256 string) error {
+	if strings.Contains(planned, diffSnippedNotice) {
+		if plannedSHA256 == "" || diffSHA256(live) == plannedSHA256 {
+			return nil
+		}
+
+		return fmt.Errorf("refusing to apply: the live diff differs from the planned diff. "+
+			"The SHA256 hash of the live diff is %s but the planned diff had %s. "+
+			"Re-run plan to review the latest changes", diffSHA256(live), plannedSHA256)
+	}
+
+	plannedResources, liveResources := normalizeDiff(planned), normalizeDiff(live)
+
+	keys := map[string]bool{}
+
+	for k := range plannedResources {
+		keys[k] = true
+	}
+
+	for k := range liveResources {
+		keys[k] = true
+	}
+
+	var mismatched []string
+
+	for k := range keys {
+		p, pok := plannedResources[k]
+		l, lok := liveResources[k]
+
+		if pok != lok || p.change != l.change || p.diff != l.diff {
+			mismatched = append(mismatched, k)
+		}
+	}
+
+	if len(mismatched) == 0 {
+		return nil
+	}
+
+	sort.Strings(mismatched)
+
+	var b strings.Builder
+
+	b.WriteString("refusing to apply: the live diff differs from the planned diff, which means the cluster or the charts have changed since the plan. " +
+		"Re-run plan to review the latest changes\n")
+
+	for _, k := range mismatched {
+		p, l := plannedResources[k], liveResources[k]
+
+		name := k
+		if name == "" {
+			name = "helmfile-diff output"
+		}
+
+		fmt.Fprintf(&b, "\n%s: planned %s, live %s\n", name, p.changeOrNone(), l.changeOrNone())
+		b.WriteString(sideBySide(p.lines(), l.lines()))
+	}
+
+	return fmt.Errorf("%s", b.String())
+}
+
+// normalizedResourceDiff is the change on a resource, that is compared regardless of whitespace differences
+type normalizedResourceDiff struct {
+	change string
+	diff   string
+}
+
+func (r normalizedResourceDiff) changeOrNone() string {
+	if r.change == "" {
+		return "no change"
+	}
+
+	return r.change
+}
+
+func (r normalizedResourceDiff) lines() []string {
+	if r.diff == "" {
+		return nil
+	}
+
+	return strings.Split(r.diff, "\n")
+}
+
+// normalizeDiff parses the diff and indexes changes by release and resource.
+// Trailing whitespaces and blank lines are ignored, and so are log lines outside of resource diffs.
+// The whole diff is indexed by the empty key when it contains no resource diff helm-diff would print.
+func normalizeDiff(diff string) map[string]normalizedResourceDiff {
+	resources := map[string]normalizedResourceDiff{}
+
+	diff = normalizeDiffLines(diff)
+
+	for _, rel := range ParseDiffOutput(diff) {
+		for _, r := range rel.Resources {
+			kind := r.Kind
+			if r.APIGroup != "" {
+				kind = fmt.Sprintf("%s (%s)", r.Kind, r.APIGroup)
+			}
+
+			k := fmt.Sprintf("release %s, %s %s", rel.Name, kind, r.Name)
+			if r.Namespace != "" {
+				k = fmt.Sprintf("release %s, %s %s/%s", rel.Name, kind, r.Namespace, r.Name)
+			}
+
+			resources[k] = normalizedResourceDiff{change: r.Change, diff: normalizeDiffLines(r.Diff)}
+		}
+	}
+
+	if len(resources) == 0 && diff != "" {
+		resources[""] = normalizedResourceDiff{change: ResourceChanged, diff: diff}
+	}
+
+	return resources
+}
+
+func normalizeDiffLines(diff string) string {
+	var lines []string
+
+	for _, l := range strings.Split(diff, "\n") {
+		l = strings.TrimRight(l, " \t\r")
+		if l == "" {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// sideBySide renders planned and live lines in two columns, marking rows that differ with `|`
+func sideBySide(planned, live []string) string {
+	n := len(planned)
+	if len(live) > n {
+		n = len(live)
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "  %-*s   %s\n", sideBySideColumnWidth, "PLANNED", "LIVE")
+
+	for i := 0; i < n; i++ {
+		var p, l string
+
+		if i < len(planned) {
+			p = planned[i]
+		}
+
+		if i < len(live) {
+			l = live[i]
+		}
+
+		sep := " "
+		if p != l {
+			sep = "|"
+		}
+
+		fmt.Fprintf(&b, "  %-*s %s %s\n", sideBySideColumnWidth, truncateColumn(p), sep, truncateColumn(l))
+	}
+
+	return b.String()
+}
+
+func truncateColumn(s string) string {
+	if len(s) <= sideBySideColumnWidth {
+		return s
+	}
+
+	return s[:sideBySideColumnWidth-3] + "..."
+}
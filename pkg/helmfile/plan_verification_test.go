@@ -0,0 +1,95 @@
+package helmfile
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerifyPlannedDiff(t *testing.T) {
+	added := approvalTestDiff + `default, podinfo-extra, ConfigMap (v1) has been added:
++ apiVersion: v1
+`
+
+	testcases := []struct {
+		name          string
+		planned, live string
+		plannedSHA256 string
+		wantErr       []string
+	}{
+		{
+			name:    "same",
+			planned: approvalTestDiff,
+			live:    approvalTestDiff + "\n",
+		},
+		{
+			name:    "added after plan",
+			planned: approvalTestDiff,
+			live:    added,
+			wantErr: []string{"release podinfo, ConfigMap (v1) default/podinfo-extra: planned no change, live added"},
+		},
+		{
+			name:    "applied by others after plan",
+			planned: approvalTestDiff,
+			live:    "",
+			wantErr: []string{"release podinfo, Deployment (apps) default/podinfo: planned changed, live no change"},
+		},
+		{
+			name:          "snipped and unchanged",
+			planned:       "...\n" + diffSnippedNotice,
+			live:          added,
+			plannedSHA256: diffSHA256(added),
+		},
+		{
+			name:          "snipped and changed",
+			planned:       "...\n" + diffSnippedNotice,
+			live:          approvalTestDiff,
+			plannedSHA256: diffSHA256(added),
+			wantErr:       []string{"SHA256 hash of the live diff is " + diffSHA256(approvalTestDiff)},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifyPlannedDiff(tc.planned, tc.live, tc.plannedSHA256)
+
+			if len(tc.wantErr) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil {
+				t.Fatal("expected error")
+			}
+
+			for _, want := range tc.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected the error to contain %q, got:\n%s", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSideBySide(t *testing.T) {
+	got := sideBySide([]string{"a", strings.Repeat("x", 100)}, []string{"a"})
+
+	lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("unexpected number of lines: %q", got)
+	}
+
+	if !strings.HasPrefix(lines[0], "  PLANNED") || !strings.HasSuffix(lines[0], "LIVE") {
+		t.Errorf("unexpected header: %q", lines[0])
+	}
+
+	if !strings.HasSuffix(lines[1], "   a") {
+		t.Errorf("unexpected unchanged row: %q", lines[1])
+	}
+
+	if !strings.Contains(lines[2], strings.Repeat("x", sideBySideColumnWidth-3)+"... |") {
+		t.Errorf("unexpected changed row: %q", lines[2])
+	}
+}
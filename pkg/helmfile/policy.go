@@ -0,0 +1,702 @@
+package helmfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+	ctyyaml "github.com/zclconf/go-cty-yaml"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
+)
+
+const KeyPolicy = "policy"
+
+// Keys of the attributes in the policy block
+const (
+	KeyPolicyMode                = "mode"
+	KeyPolicyDeniedKinds         = "denied_kinds"
+	KeyPolicyDeniedNamespaces    = "denied_namespaces"
+	KeyPolicyRequiredLabels      = "required_labels"
+	KeyPolicyRequiredAnnotations = "required_annotations"
+	KeyPolicyAllowedRegistries   = "allowed_registries"
+	KeyPolicyDenyLatestTag       = "deny_latest_tag"
+	KeyPolicyDenyPrivileged      = "deny_privileged"
+)
+
+const (
+	PolicyModeDeny = "deny"
+	PolicyModeWarn = "warn"
+)
+
+// Names of policy rules shown in violations
+const (
+	PolicyRuleDeniedKind         = "denied_kind"
+	PolicyRuleDeniedNamespace    = "denied_namespace"
+	PolicyRuleRequiredLabel      = "required_label"
+	PolicyRuleRequiredAnnotation = "required_annotation"
+	PolicyRuleAllowedRegistry    = "allowed_registry"
+	PolicyRuleLatestTag          = "latest_tag"
+	PolicyRulePrivileged         = "privileged"
+)
+
+var policyStringListSchema = &schema.Schema{
+	Type:     schema.TypeList,
+	Optional: true,
+	Elem: &schema.Schema{
+		Type: schema.TypeString,
+	},
+}
+
+// policySchema is the schema for the policy block, whose rules are checked against manifests rendered on plan
+var policySchema = &schema.Schema{
+	Type:     schema.TypeList,
+	Optional: true,
+	MaxItems: 1,
+	Elem: &schema.Resource{
+		Schema: map[string]*schema.Schema{
+			KeyPolicyMode: {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      PolicyModeDeny,
+				ValidateFunc: validation.StringInSlice([]string{PolicyModeDeny, PolicyModeWarn}, false),
+			},
+			KeyPolicyDeniedKinds:         policyStringListSchema,
+			KeyPolicyDeniedNamespaces:    policyStringListSchema,
+			KeyPolicyRequiredLabels:      policyStringListSchema,
+			KeyPolicyRequiredAnnotations: policyStringListSchema,
+			KeyPolicyAllowedRegistries:   policyStringListSchema,
+			KeyPolicyDenyLatestTag: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			KeyPolicyDenyPrivileged: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+		},
+	},
+}
+
+// Policy is the set of rules that manifests rendered for the release set must satisfy
+type Policy struct {
+	// Mode is either PolicyModeDeny to fail the plan on violations, or PolicyModeWarn to only log them
+	Mode string
+
+	DeniedKinds         []string
+	DeniedNamespaces    []string
+	RequiredLabels      []string
+	RequiredAnnotations []string
+
+	// AllowedRegistries is the list of registries like `ghcr.io`, or repository prefixes like `ghcr.io/myorg`,
+	// that container images must be pulled from. Any registry is allowed when empty.
+	AllowedRegistries []string
+
+	DenyLatestTag  bool
+	DenyPrivileged bool
+
+	// Files is the list of Rego policy files evaluated against rendered manifests and the helmfile build output.
+	// Their deny rules fail the plan regardless of Mode.
+	Files []string
+}
+
+// PolicyViolation is a resource that doesn't satisfy a rule of the policy
+type PolicyViolation struct {
+	Release   string
+	Namespace string
+	Kind      string
+	Name      string
+	Rule      string
+	Message   string
+}
+
+func (v PolicyViolation) String() string {
+	if v.Kind == "" {
+		// Violations found in the helmfile build output aren't specific to a resource
+		return fmt.Sprintf("helmfile state: %s: %s", v.Rule, v.Message)
+	}
+
+	return fmt.Sprintf("release %q: %s %s/%s: %s: %s", v.Release, v.Kind, v.Namespace, v.Name, v.Rule, v.Message)
+}
+
+// PolicyViolations is the error returned when one or more resources violate the policy in the deny mode
+type PolicyViolations []PolicyViolation
+
+func (vs PolicyViolations) Error() string {
+	lines := []string{fmt.Sprintf("%d policy violation(s) found in rendered manifests:", len(vs))}
+
+	for _, v := range vs {
+		lines = append(lines, "- "+v.String())
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// getPolicy reads the policy block and policy_files of the resource. It returns nil when neither is set.
+func getPolicy(d ResourceRead) *Policy {
+	files := toStrings(d.Get(KeyPolicyFiles))
+
+	var m map[string]interface{}
+
+	if items, ok := d.Get(KeyPolicy).([]interface{}); ok && len(items) > 0 && items[0] != nil {
+		m = items[0].(map[string]interface{})
+	}
+
+	if m == nil && len(files) == 0 {
+		return nil
+	}
+
+	p := &Policy{
+		Files:               files,
+		Mode:                PolicyModeDeny,
+		DeniedKinds:         toStrings(m[KeyPolicyDeniedKinds]),
+		DeniedNamespaces:    toStrings(m[KeyPolicyDeniedNamespaces]),
+		RequiredLabels:      toStrings(m[KeyPolicyRequiredLabels]),
+		RequiredAnnotations: toStrings(m[KeyPolicyRequiredAnnotations]),
+		AllowedRegistries:   toStrings(m[KeyPolicyAllowedRegistries]),
+	}
+
+	if v, ok := m[KeyPolicyMode].(string); ok && v != "" {
+		p.Mode = v
+	}
+
+	if v, ok := m[KeyPolicyDenyLatestTag].(bool); ok {
+		p.DenyLatestTag = v
+	}
+
+	if v, ok := m[KeyPolicyDenyPrivileged].(bool); ok {
+		p.DenyPrivileged = v
+	}
+
+	return p
+}
+
+// CheckPolicy renders manifests of the release set and checks them against the policy.
+//
+// It returns violations of rules in the warn mode and warn rules of Rego policies, which are also logged.
+// Violations that fail the plan are returned as PolicyViolations.
+func CheckPolicy(ctx *sdk.Context, fs *ReleaseSet, p *Policy) (PolicyViolations, error) {
+	fs.logf("[DEBUG] Checking rendered manifests against the policy...")
+
+	manifests, states, err := renderManifests(ctx, fs)
+	if err != nil {
+		return nil, fmt.Errorf("rendering manifests for policy checks: %w", err)
+	}
+
+	var denies, warnings PolicyViolations
+
+	if p.Mode == PolicyModeWarn {
+		warnings = p.check(manifests)
+	} else {
+		denies = p.check(manifests)
+	}
+
+	if len(p.Files) > 0 {
+		rp, err := loadRegoPolicies(p.Files)
+		if err != nil {
+			return nil, err
+		}
+
+		d, w, err := rp.check(fs.context(), manifests, states)
+		if err != nil {
+			return nil, err
+		}
+
+		denies = append(denies, d...)
+		warnings = append(warnings, w...)
+	}
+
+	for _, v := range warnings {
+		fs.logFields(LogLevelWarn, "Policy violation",
+			logField{Key: "release", Value: v.Release},
+			logField{Key: "resource", Value: fmt.Sprintf("%s %s/%s", v.Kind, v.Namespace, v.Name)},
+			logField{Key: "rule", Value: v.Rule},
+			logField{Key: "message", Value: v.Message},
+		)
+	}
+
+	if len(denies) > 0 {
+		return warnings, denies
+	}
+
+	return warnings, nil
+}
+
+// manifest is a Kubernetes resource rendered for a release
+type manifest struct {
+	Release string
+	Object  map[string]interface{}
+}
+
+// resourcePlan is the subset of schema.ResourceDiff that planPolicyWarnings needs
+type resourcePlan interface {
+	ResourceRead
+	HasChange(string) bool
+	SetNew(string, interface{}) error
+}
+
+// planPolicyWarnings checks the manifests against the policy when either the manifests or the policy are changing,
+// and plans policy_warnings from the result.
+// Warnings of the previous check are kept as long as none of them changes, and cleared when the policy is removed.
+func planPolicyWarnings(ctx *sdk.Context, fs *ReleaseSet, d resourcePlan, manifestsChanged bool) error {
+	ws := []string{}
+
+	if p := getPolicy(d); p != nil {
+		if !manifestsChanged && !d.HasChange(KeyPolicy) && !d.HasChange(KeyPolicyFiles) {
+			return nil
+		}
+
+		warnings, err := CheckPolicy(ctx, fs, p)
+		if err != nil {
+			return fmt.Errorf("checking policy: %w", err)
+		}
+
+		for _, w := range warnings {
+			ws = append(ws, w.String())
+		}
+	}
+
+	if err := d.SetNew(KeyPolicyWarnings, ws); err != nil {
+		return fmt.Errorf("setting %s: %w", KeyPolicyWarnings, err)
+	}
+
+	return nil
+}
+
+// renderManifests runs `helmfile template --output-dir` and reads the rendered resources per release.
+// It also returns documents of the `helmfile build` output, one per helmfile state.
+// Neither command accesses the cluster, so that policies can be checked before the cluster is created.
+//
+// Manifests are written to files, rather than read from the command output, so that helmfile and helm log lines
+// interleaved in the output are never parsed as resources.
+func renderManifests(ctx *sdk.Context, fs *ReleaseSet) ([]manifest, []map[string]interface{}, error) {
+	states, err := buildHelmfileStates(ctx, fs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	namespaces, err := releaseNamespaces(states)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "helmfile-policy")
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating directory for rendered manifests: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	args := []string{
+		"--output-dir", dir,
+	}
+
+	for k, v := range fs.ReleasesValues {
+		args = append(args, "--set", fmt.Sprintf("%s=%s", k, v))
+	}
+
+	if _, err := runTemplate(ctx, fs, args...); err != nil {
+		return nil, nil, fmt.Errorf("running helmfile template: %w", err)
+	}
+
+	manifests, err := readRenderedManifests(dir, namespaces)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return manifests, states, nil
+}
+
+// readRenderedManifests reads manifests from the directory that `helmfile template --output-dir` wrote into.
+//
+// helmfile writes manifests for each release into the directory named `<state file>-<hash>-<release name>`,
+// which is matched against release names to know which release the resource belongs to.
+// Resources without metadata.namespace are attributed to the namespace of the release.
+func readRenderedManifests(dir string, namespaces map[string]string) ([]manifest, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading rendered manifests: %w", err)
+	}
+
+	var manifests []manifest
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		release := releaseForOutputDir(e.Name(), namespaces)
+
+		err := filepath.Walk(filepath.Join(dir, e.Name()), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if info.IsDir() || (filepath.Ext(path) != ".yaml" && filepath.Ext(path) != ".yml") {
+				return nil
+			}
+
+			src, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			objs, err := parseManifests(src)
+			if err != nil {
+				return fmt.Errorf("parsing %s: %w", path, err)
+			}
+
+			for _, o := range objs {
+				if md, ok := o["metadata"].(map[string]interface{}); ok {
+					if ns, _ := md["namespace"].(string); ns == "" {
+						md["namespace"] = namespaces[release]
+					}
+				}
+
+				manifests = append(manifests, manifest{Release: release, Object: o})
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading rendered manifests: %w", err)
+		}
+	}
+
+	return manifests, nil
+}
+
+// releaseForOutputDir returns the longest release name that the directory name ends with
+func releaseForOutputDir(dir string, namespaces map[string]string) string {
+	var release string
+
+	for name := range namespaces {
+		if strings.HasSuffix(dir, "-"+name) && len(name) > len(release) {
+			release = name
+		}
+	}
+
+	if release == "" {
+		return dir
+	}
+
+	return release
+}
+
+// parseManifests parses the multi-document YAML into Kubernetes resources. Empty documents are skipped.
+func parseManifests(src []byte) ([]map[string]interface{}, error) {
+	var (
+		objs []map[string]interface{}
+		doc  []string
+	)
+
+	parse := func() error {
+		defer func() { doc = nil }()
+
+		src := []byte(strings.Join(doc, "\n"))
+
+		if len(bytes.TrimSpace(removeYAMLComments(src))) == 0 {
+			return nil
+		}
+
+		ty, err := ctyyaml.Standard.ImpliedType(src)
+		if err != nil {
+			return err
+		}
+
+		v, err := ctyyaml.Standard.Unmarshal(src, ty)
+		if err != nil {
+			return err
+		}
+
+		if v.IsNull() {
+			return nil
+		}
+
+		j, err := ctyjson.Marshal(v, ty)
+		if err != nil {
+			return err
+		}
+
+		var o map[string]interface{}
+
+		if err := json.Unmarshal(j, &o); err != nil {
+			return err
+		}
+
+		objs = append(objs, o)
+
+		return nil
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(src))
+	s.Buffer(make([]byte, 64*1024), 10*1024*1024)
+
+	for s.Scan() {
+		l := s.Text()
+
+		if strings.HasPrefix(l, "---") && strings.TrimSpace(strings.TrimLeft(l, "-")) == "" {
+			if err := parse(); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		doc = append(doc, l)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := parse(); err != nil {
+		return nil, err
+	}
+
+	return objs, nil
+}
+
+func removeYAMLComments(src []byte) []byte {
+	var buf bytes.Buffer
+
+	for _, l := range strings.Split(string(src), "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(l), "#") {
+			buf.WriteString(l)
+			buf.WriteString("\n")
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// helmfileState is the subset of `helmfile build` output to know namespaces of releases
+type helmfileState struct {
+	Releases []struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"releases"`
+}
+
+// buildHelmfileStates runs `helmfile build` and returns the helmfile states, one per helmfile.yaml or sub-helmfile
+func buildHelmfileStates(ctx *sdk.Context, fs *ReleaseSet) ([]map[string]interface{}, error) {
+	st, err := runBuild(ctx, fs)
+	if err != nil {
+		return nil, fmt.Errorf("running helmfile build: %w", err)
+	}
+
+	docs, err := parseManifests([]byte(st.Output))
+	if err != nil {
+		return nil, fmt.Errorf("parsing helmfile build output: %w", err)
+	}
+
+	return docs, nil
+}
+
+// releaseNamespaces returns the map of release names to their namespaces in the helmfile states
+func releaseNamespaces(docs []map[string]interface{}) (map[string]string, error) {
+	namespaces := map[string]string{}
+
+	for _, d := range docs {
+		j, err := json.Marshal(d)
+		if err != nil {
+			return nil, err
+		}
+
+		var st helmfileState
+
+		if err := json.Unmarshal(j, &st); err != nil {
+			return nil, fmt.Errorf("parsing helmfile build output: %w", err)
+		}
+
+		for _, r := range st.Releases {
+			namespaces[r.Name] = r.Namespace
+		}
+	}
+
+	return namespaces, nil
+}
+
+func (p *Policy) check(manifests []manifest) PolicyViolations {
+	var violations PolicyViolations
+
+	for _, m := range manifests {
+		md, _ := m.Object["metadata"].(map[string]interface{})
+		kind, _ := m.Object["kind"].(string)
+		name, _ := md["name"].(string)
+		namespace, _ := md["namespace"].(string)
+
+		violate := func(rule, format string, args ...interface{}) {
+			violations = append(violations, PolicyViolation{
+				Release:   m.Release,
+				Namespace: namespace,
+				Kind:      kind,
+				Name:      name,
+				Rule:      rule,
+				Message:   fmt.Sprintf(format, args...),
+			})
+		}
+
+		if contains(p.DeniedKinds, kind) {
+			violate(PolicyRuleDeniedKind, "kind %s is denied", kind)
+		}
+
+		if contains(p.DeniedNamespaces, namespace) {
+			violate(PolicyRuleDeniedNamespace, "namespace %q is denied", namespace)
+		}
+
+		labels, _ := md["labels"].(map[string]interface{})
+
+		for _, l := range p.RequiredLabels {
+			if _, ok := labels[l]; !ok {
+				violate(PolicyRuleRequiredLabel, "label %q is missing", l)
+			}
+		}
+
+		annotations, _ := md["annotations"].(map[string]interface{})
+
+		for _, a := range p.RequiredAnnotations {
+			if _, ok := annotations[a]; !ok {
+				violate(PolicyRuleRequiredAnnotation, "annotation %q is missing", a)
+			}
+		}
+
+		for _, c := range podContainers(m.Object) {
+			cname, _ := c["name"].(string)
+			image, _ := c["image"].(string)
+
+			if len(p.AllowedRegistries) > 0 && !registryAllowed(image, p.AllowedRegistries) {
+				violate(PolicyRuleAllowedRegistry, "image %q of container %q is not from allowed registries", image, cname)
+			}
+
+			if p.DenyLatestTag && isLatestImage(image) {
+				violate(PolicyRuleLatestTag, "image %q of container %q uses the latest tag", image, cname)
+			}
+
+			if p.DenyPrivileged {
+				if sc, ok := c["securityContext"].(map[string]interface{}); ok && sc["privileged"] == true {
+					violate(PolicyRulePrivileged, "container %q is privileged", cname)
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(violations, func(i, j int) bool {
+		return violations[i].Release < violations[j].Release
+	})
+
+	return violations
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// podContainers returns containers and init containers of the pod template in the workload, or of the pod itself
+func podContainers(o map[string]interface{}) []map[string]interface{} {
+	kind, _ := o["kind"].(string)
+
+	var path []string
+
+	switch kind {
+	case "Pod":
+		path = []string{"spec"}
+	case "CronJob":
+		path = []string{"spec", "jobTemplate", "spec", "template", "spec"}
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job", "ReplicationController":
+		path = []string{"spec", "template", "spec"}
+	default:
+		return nil
+	}
+
+	var spec interface{} = o
+
+	for _, k := range path {
+		m, ok := spec.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		spec = m[k]
+	}
+
+	podSpec, ok := spec.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var containers []map[string]interface{}
+
+	for _, k := range []string{"initContainers", "containers"} {
+		items, _ := podSpec[k].([]interface{})
+
+		for _, item := range items {
+			if c, ok := item.(map[string]interface{}); ok {
+				containers = append(containers, c)
+			}
+		}
+	}
+
+	return containers
+}
+
+// imageRegistry returns the registry of the image, that is `docker.io` for images like `nginx` and `bitnami/redis`
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+
+	return "docker.io"
+}
+
+func registryAllowed(image string, allowed []string) bool {
+	registry := imageRegistry(image)
+
+	ref := image
+	if !strings.HasPrefix(image, registry+"/") {
+		ref = registry + "/" + image
+	}
+
+	for _, a := range allowed {
+		a = strings.TrimSuffix(a, "/")
+
+		if a == registry || strings.HasPrefix(ref, a+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isLatestImage returns true when the image is tagged `latest`, or is neither tagged nor pinned by digest
+func isLatestImage(image string) bool {
+	if strings.Contains(image, "@") {
+		return false
+	}
+
+	name := image[strings.LastIndex(image, "/")+1:]
+
+	i := strings.LastIndex(name, ":")
+	if i < 0 {
+		return true
+	}
+
+	return name[i+1:] == "latest"
+}
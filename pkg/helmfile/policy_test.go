@@ -0,0 +1,373 @@
+package helmfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+const policyTestDeployment = `---
+# Source: podinfo/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: podinfo
+  labels:
+    app: podinfo
+spec:
+  replicas: 1
+  template:
+    metadata:
+      annotations: null
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+      containers:
+      - name: podinfo
+        image: "ghcr.io/stefanprodan/podinfo:5.1.1"
+        securityContext:
+          privileged: true
+        ports: []
+`
+
+const policyTestService = `---
+# Source: podinfo/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: podinfo
+  namespace: kube-system
+  labels:
+    app: podinfo
+    team: web
+  annotations:
+    owner: web
+spec:
+  ports:
+  - port: 9898
+`
+
+func writeRenderedManifests(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"helmfile-0123abcd-podinfo/podinfo/templates/deployment.yaml": policyTestDeployment,
+		"helmfile-0123abcd-podinfo/podinfo/templates/service.yaml":    policyTestService,
+		"helmfile-0123abcd-podinfo/podinfo/templates/NOTES.txt":       "not a manifest",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestReadRenderedManifests(t *testing.T) {
+	dir := writeRenderedManifests(t)
+
+	manifests, err := readRenderedManifests(dir, map[string]string{"podinfo": "apps", "info": "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(manifests) != 2 {
+		t.Fatalf("expected 2 manifests, got %d", len(manifests))
+	}
+
+	for _, m := range manifests {
+		if m.Release != "podinfo" {
+			t.Errorf("unexpected release: %s", m.Release)
+		}
+
+		md := m.Object["metadata"].(map[string]interface{})
+
+		want := "apps"
+		if m.Object["kind"] == "Service" {
+			want = "kube-system"
+		}
+
+		if md["namespace"] != want {
+			t.Errorf("unexpected namespace of %s: want %s, got %v", m.Object["kind"], want, md["namespace"])
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	dir := writeRenderedManifests(t)
+
+	manifests, err := readRenderedManifests(dir, map[string]string{"podinfo": "apps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Policy{
+		Mode:                PolicyModeDeny,
+		DeniedKinds:         []string{"Service"},
+		DeniedNamespaces:    []string{"kube-system"},
+		RequiredLabels:      []string{"team"},
+		RequiredAnnotations: []string{"owner"},
+		AllowedRegistries:   []string{"ghcr.io/stefanprodan"},
+		DenyLatestTag:       true,
+		DenyPrivileged:      true,
+	}
+
+	got := map[string]bool{}
+
+	for _, v := range p.check(manifests) {
+		got[v.Kind+" "+v.Rule] = true
+	}
+
+	want := []string{
+		"Service " + PolicyRuleDeniedKind,
+		"Service " + PolicyRuleDeniedNamespace,
+		"Deployment " + PolicyRuleRequiredLabel,
+		"Deployment " + PolicyRuleRequiredAnnotation,
+		"Deployment " + PolicyRuleAllowedRegistry,
+		"Deployment " + PolicyRuleLatestTag,
+		"Deployment " + PolicyRulePrivileged,
+	}
+
+	for _, w := range want {
+		if !got[w] {
+			t.Errorf("missing violation %q in %v", w, got)
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Errorf("unexpected violations: %v", got)
+	}
+
+	err = p.check(manifests)
+	if !strings.Contains(err.Error(), `release "podinfo": Deployment apps/podinfo: privileged: container "podinfo" is privileged`) {
+		t.Errorf("unexpected error message: %s", err.Error())
+	}
+}
+
+func TestImageRules(t *testing.T) {
+	registries := map[string]string{
+		"nginx":                        "docker.io",
+		"bitnami/redis:6.0":            "docker.io",
+		"ghcr.io/stefanprodan/podinfo": "ghcr.io",
+		"localhost:5000/app":           "localhost:5000",
+		"localhost/app":                "localhost",
+	}
+
+	for image, want := range registries {
+		if got := imageRegistry(image); got != want {
+			t.Errorf("unexpected registry of %s: want %s, got %s", image, want, got)
+		}
+	}
+
+	latest := map[string]bool{
+		"nginx":                      true,
+		"nginx:latest":               true,
+		"nginx:1.19":                 false,
+		"localhost:5000/app":         true,
+		"localhost:5000/app:v1":      false,
+		"nginx@sha256:0123456789abc": false,
+	}
+
+	for image, want := range latest {
+		if got := isLatestImage(image); got != want {
+			t.Errorf("unexpected result for %s: want %v, got %v", image, want, got)
+		}
+	}
+
+	if !registryAllowed("nginx:1.19", []string{"docker.io"}) {
+		t.Errorf("expected docker.io to be allowed")
+	}
+
+	if registryAllowed("ghcr.io/other/app", []string{"ghcr.io/myorg"}) {
+		t.Errorf("expected ghcr.io/other to be denied")
+	}
+}
+
+func TestGetPolicy(t *testing.T) {
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig: "kubeconfig",
+		KeyPolicy: []interface{}{
+			map[string]interface{}{
+				KeyPolicyMode:        PolicyModeWarn,
+				KeyPolicyDeniedKinds: []interface{}{"ClusterRole"},
+			},
+		},
+	})
+
+	p := getPolicy(d)
+	if p == nil {
+		t.Fatal("expected the policy")
+	}
+
+	if p.Mode != PolicyModeWarn || len(p.DeniedKinds) != 1 || p.DeniedKinds[0] != "ClusterRole" || p.DenyPrivileged {
+		t.Errorf("unexpected policy: %+v", p)
+	}
+
+	d = schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig: "kubeconfig",
+	})
+
+	if p := getPolicy(d); p != nil {
+		t.Errorf("expected no policy, got %+v", p)
+	}
+}
+
+// newFakePolicyReleaseSet returns the release set whose helmfile builds a single release and renders the deployment,
+// without kubeconfig so that policies are known to be checked without the cluster.
+func newFakePolicyReleaseSet(t *testing.T) *ReleaseSet {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	manifests := filepath.Join(dir, "manifests")
+
+	if err := os.MkdirAll(manifests, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(manifests, "deployment.yaml"), []byte(policyTestDeployment), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	bin := filepath.Join(dir, "helmfile")
+	script := `#!/bin/sh
+for a in "$@"; do
+  if [ "$prev" = "--output-dir" ]; then out="$a"; fi
+  prev="$a"
+done
+case " $* " in
+*" build "*)
+  printf -- '---\nfilepath: helmfile.yaml\nreleases:\n- name: podinfo\n  namespace: apps\n'
+  ;;
+*" template "*)
+  mkdir -p "$out/helmfile-0123abcd-podinfo/podinfo/templates"
+  cp ` + manifests + `/deployment.yaml "$out/helmfile-0123abcd-podinfo/podinfo/templates/"
+  ;;
+esac
+`
+
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return &ReleaseSet{
+		Bin:              bin,
+		Content:          "releases: []\n",
+		WorkingDirectory: dir,
+	}
+}
+
+type fakeResourcePlan struct {
+	*schema.ResourceData
+
+	changed map[string]bool
+	planned map[string]interface{}
+}
+
+func (p *fakeResourcePlan) HasChange(key string) bool {
+	return p.changed[key]
+}
+
+func (p *fakeResourcePlan) SetNew(key string, v interface{}) error {
+	p.planned[key] = v
+
+	return nil
+}
+
+func TestPlanPolicyWarnings(t *testing.T) {
+	warnPolicy := []interface{}{
+		map[string]interface{}{
+			KeyPolicyMode:           PolicyModeWarn,
+			KeyPolicyDenyPrivileged: true,
+		},
+	}
+
+	testcases := []struct {
+		name             string
+		policy           []interface{}
+		changed          map[string]bool
+		manifestsChanged bool
+		want             []string
+		wantUnchanged    bool
+	}{
+		{
+			name:             "manifests changed",
+			policy:           warnPolicy,
+			manifestsChanged: true,
+			want:             []string{`release "podinfo": Deployment apps/podinfo: privileged: container "podinfo" is privileged`},
+		},
+		{
+			name:    "policy changed without manifest changes",
+			policy:  warnPolicy,
+			changed: map[string]bool{KeyPolicy: true},
+			want:    []string{`release "podinfo": Deployment apps/podinfo: privileged: container "podinfo" is privileged`},
+		},
+		{
+			name:          "nothing changed",
+			policy:        warnPolicy,
+			wantUnchanged: true,
+		},
+		{
+			name:             "no violations",
+			policy:           []interface{}{map[string]interface{}{KeyPolicyMode: PolicyModeWarn, KeyPolicyDeniedKinds: []interface{}{"ClusterRole"}}},
+			manifestsChanged: true,
+			want:             []string{},
+		},
+		{
+			name:    "policy removed",
+			changed: map[string]bool{KeyPolicy: true},
+			want:    []string{},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := newFakePolicyReleaseSet(t)
+
+			raw := map[string]interface{}{}
+			if tc.policy != nil {
+				raw[KeyPolicy] = tc.policy
+			}
+
+			d := &fakeResourcePlan{
+				ResourceData: schema.TestResourceDataRaw(t, ReleaseSetSchema, raw),
+				changed:      tc.changed,
+				planned:      map[string]interface{}{},
+			}
+
+			if err := planPolicyWarnings(&sdk.Context{}, fs, d, tc.manifestsChanged); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got, ok := d.planned[KeyPolicyWarnings]
+			if tc.wantUnchanged {
+				if ok {
+					t.Errorf("expected %s to be unchanged, got %v", KeyPolicyWarnings, got)
+				}
+
+				return
+			}
+
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("unexpected %s: want %#v, got %#v", KeyPolicyWarnings, tc.want, got)
+			}
+		})
+	}
+}
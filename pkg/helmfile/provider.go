@@ -1,13 +1,19 @@
 package helmfile
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/terraform-plugin-sdk/helper/mutexkv"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 	"github.com/hashicorp/terraform-plugin-sdk/terraform"
 )
 
 const (
 	KeyMaxDiffOutputLen = "max_diff_output_len"
+	KeyShoalSyncTimeout = "shoal_sync_timeout"
+	KeyBinaryCacheDir   = "binary_cache_dir"
 )
 
 // Provider returns a terraform.ResourceProvider.
@@ -20,6 +26,59 @@ func Provider() terraform.ResourceProvider {
 				ForceNew: false,
 				Default:  4096,
 			},
+			KeyShoalSyncTimeout: {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     false,
+				Default:      "60s",
+				ValidateFunc: validateDuration,
+			},
+			KeyBinaryCacheDir: {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+				Default:  "",
+			},
+			KeyHelmPlugins: {
+				Type:     schema.TypeMap,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			KeyAuditLog: {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+				Default:  "",
+			},
+			KeyOTLPEndpoint: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    false,
+				DefaultFunc: schema.EnvDefaultFunc(EnvOTLPEndpoint, ""),
+			},
+			KeyTraceFile: {
+				Type:        schema.TypeString,
+				Optional:    true,
+				ForceNew:    false,
+				DefaultFunc: schema.EnvDefaultFunc(EnvTraceFile, ""),
+			},
+			KeyLogLevel: {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     false,
+				Default:      LogLevelDebug,
+				ValidateFunc: validation.StringInSlice(logLevels, false),
+			},
+			KeyLogFormat: {
+				Type:         schema.TypeString,
+				Optional:     true,
+				ForceNew:     false,
+				Default:      LogFormatText,
+				ValidateFunc: validation.StringInSlice(logFormats, false),
+			},
 		},
 		ResourcesMap: map[string]*schema.Resource{
 			"helmfile_release_set":       resourceHelmfileReleaseSet(),
@@ -31,7 +90,15 @@ func Provider() terraform.ResourceProvider {
 }
 
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
-	return New(d), nil
+	return New(d)
+}
+
+func validateDuration(v interface{}, k string) ([]string, []error) {
+	if _, err := time.ParseDuration(v.(string)); err != nil {
+		return nil, []error{fmt.Errorf("%s must be a valid duration like \"60s\" or \"5m\": %w", k, err)}
+	}
+
+	return nil, nil
 }
 
 // This is a global MutexKV for use within this plugin.
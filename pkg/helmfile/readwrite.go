@@ -14,10 +14,13 @@ type ResourceReadWrite interface {
 
 type ResourceReadWriteEmbedded struct {
 	m map[string]interface{}
+
+	// id is the key that identifies the embedded entry across plans
+	id string
 }
 
 func (m *ResourceReadWriteEmbedded) Id() string {
-	return ""
+	return m.id
 }
 
 func (m *ResourceReadWriteEmbedded) Get(k string) interface{} {
@@ -0,0 +1,173 @@
+package helmfile
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/rego"
+)
+
+const KeyPolicyFiles = "policy_files"
+
+// KeyPolicyWarnings is the key of the computed attribute that shows policy warnings in the plan
+const KeyPolicyWarnings = "policy_warnings"
+
+// Names of rules read from Rego policies, in the same convention as conftest
+const (
+	regoRuleDeny = "deny"
+	regoRuleWarn = "warn"
+)
+
+// regoPolicies is the set of compiled Rego policies evaluated in-process
+type regoPolicies struct {
+	queries []regoQuery
+}
+
+type regoQuery struct {
+	// rule is the fully qualified name of the rule like data.main.deny
+	rule string
+	deny bool
+
+	query rego.PreparedEvalQuery
+}
+
+// loadRegoPolicies compiles the Rego policy files.
+// Each package in the files can define `deny` and `warn` rules that produce messages.
+func loadRegoPolicies(files []string) (*regoPolicies, error) {
+	modules := map[string]*ast.Module{}
+
+	for _, f := range files {
+		src, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("reading policy file %s: %w", f, err)
+		}
+
+		m, err := ast.ParseModule(f, string(src))
+		if err != nil {
+			return nil, fmt.Errorf("parsing policy file %s: %w", f, err)
+		}
+
+		modules[f] = m
+	}
+
+	compiler := ast.NewCompiler()
+	if compiler.Compile(modules); compiler.Failed() {
+		return nil, fmt.Errorf("compiling policy files: %w", compiler.Errors)
+	}
+
+	packages := map[string]bool{}
+
+	for _, m := range modules {
+		packages[m.Package.Path.String()] = true
+	}
+
+	var names []string
+
+	for p := range packages {
+		names = append(names, p)
+	}
+
+	sort.Strings(names)
+
+	var r regoPolicies
+
+	for _, p := range names {
+		for _, rule := range []string{regoRuleDeny, regoRuleWarn} {
+			q := p + "." + rule
+
+			pq, err := rego.New(rego.Compiler(compiler), rego.Query(q)).PrepareForEval(context.Background())
+			if err != nil {
+				return nil, fmt.Errorf("preparing policy query %s: %w", q, err)
+			}
+
+			r.queries = append(r.queries, regoQuery{rule: q, deny: rule == regoRuleDeny, query: pq})
+		}
+	}
+
+	return &r, nil
+}
+
+// check evaluates policies against each manifest and each helmfile state as the input
+func (r *regoPolicies) check(ctx context.Context, manifests []manifest, states []map[string]interface{}) (PolicyViolations, PolicyViolations, error) {
+	var denies, warnings PolicyViolations
+
+	eval := func(input map[string]interface{}, v PolicyViolation) error {
+		for _, q := range r.queries {
+			msgs, err := q.eval(ctx, input)
+			if err != nil {
+				return err
+			}
+
+			for _, msg := range msgs {
+				v.Rule = q.rule
+				v.Message = msg
+
+				if q.deny {
+					denies = append(denies, v)
+				} else {
+					warnings = append(warnings, v)
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for _, m := range manifests {
+		md, _ := m.Object["metadata"].(map[string]interface{})
+
+		v := PolicyViolation{Release: m.Release}
+		v.Kind, _ = m.Object["kind"].(string)
+		v.Name, _ = md["name"].(string)
+		v.Namespace, _ = md["namespace"].(string)
+
+		if err := eval(m.Object, v); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, st := range states {
+		if err := eval(st, PolicyViolation{}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return denies, warnings, nil
+}
+
+// eval returns messages produced by the rule. A message is either a string or the `msg` field of an object.
+func (q regoQuery) eval(ctx context.Context, input map[string]interface{}) ([]string, error) {
+	rs, err := q.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, fmt.Errorf("evaluating %s: %w", q.rule, err)
+	}
+
+	var msgs []string
+
+	for _, r := range rs {
+		for _, e := range r.Expressions {
+			values, ok := e.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("evaluating %s: expected a set of messages, got %v", q.rule, e.Value)
+			}
+
+			for _, v := range values {
+				switch t := v.(type) {
+				case string:
+					msgs = append(msgs, t)
+				case map[string]interface{}:
+					msgs = append(msgs, fmt.Sprintf("%v", t["msg"]))
+				default:
+					msgs = append(msgs, fmt.Sprintf("%v", t))
+				}
+			}
+		}
+	}
+
+	sort.Strings(msgs)
+
+	return msgs, nil
+}
@@ -0,0 +1,106 @@
+package helmfile
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const regoTestPolicy = `package main
+
+deny[msg] {
+	input.kind == "Deployment"
+	not input.spec.template.spec.securityContext.runAsNonRoot
+
+	msg := sprintf("%s must run as non-root", [input.metadata.name])
+}
+
+warn[{"msg": msg}] {
+	input.kind == "Service"
+	input.spec.type == "LoadBalancer"
+
+	msg := "LoadBalancer services cost money"
+}
+
+deny[msg] {
+	r := input.releases[_]
+	not r.namespace
+
+	msg := sprintf("release %s must have a namespace", [r.name])
+}
+`
+
+func TestRegoPolicies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.rego")
+
+	if err := ioutil.WriteFile(path, []byte(regoTestPolicy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err := loadRegoPolicies([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifests := []manifest{
+		{
+			Release: "podinfo",
+			Object: map[string]interface{}{
+				"kind":     "Deployment",
+				"metadata": map[string]interface{}{"name": "podinfo", "namespace": "apps"},
+			},
+		},
+		{
+			Release: "podinfo",
+			Object: map[string]interface{}{
+				"kind":     "Service",
+				"metadata": map[string]interface{}{"name": "podinfo", "namespace": "apps"},
+				"spec":     map[string]interface{}{"type": "LoadBalancer"},
+			},
+		},
+	}
+
+	states := []map[string]interface{}{
+		{
+			"releases": []interface{}{
+				map[string]interface{}{"name": "podinfo", "namespace": "apps"},
+				map[string]interface{}{"name": "redis"},
+			},
+		},
+	}
+
+	denies, warnings, err := rp.check(context.Background(), manifests, states)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(denies) != 2 {
+		t.Fatalf("expected 2 denies, got %v", denies)
+	}
+
+	if got := denies[0].String(); got != `release "podinfo": Deployment apps/podinfo: data.main.deny: podinfo must run as non-root` {
+		t.Errorf("unexpected deny: %s", got)
+	}
+
+	if got := denies[1].String(); got != `helmfile state: data.main.deny: release redis must have a namespace` {
+		t.Errorf("unexpected deny: %s", got)
+	}
+
+	if len(warnings) != 1 || warnings[0].Message != "LoadBalancer services cost money" || warnings[0].Rule != "data.main.warn" {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestRegoPoliciesInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invalid.rego")
+
+	if err := ioutil.WriteFile(path, []byte("package main\n\ndeny[msg] {"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadRegoPolicies([]string{path}); err == nil || !strings.Contains(err.Error(), "parsing policy file") {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+}
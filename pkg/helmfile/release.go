@@ -1,5 +1,45 @@
 package helmfile
 
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Repository is a chart repository or an OCI registry from which the release's chart is fetched
+type Repository struct {
+	Name     string
+	URL      string
+	OCI      bool
+	Username Sensitive
+	Password Sensitive
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// Hook is a helmfile hook that runs the command on the events
+type Hook struct {
+	Events   []string
+	ShowLogs bool
+	Command  string
+	Args     []string
+}
+
+// SetValue is an item in `set` or `setString` of a helmfile release
+type SetValue struct {
+	Name  string
+	Value string
+	File  string
+}
+
+// Dependency is a chart that is added to the release's chart as a dependency by chartify
+type Dependency struct {
+	Chart   string
+	Version string
+	Alias   string
+}
+
 type Release struct {
 	Name             string
 	Namespace        string
@@ -17,8 +57,40 @@ type Release struct {
 	Kubecontext      string
 	Bin              string
 	HelmBin          string
-	DiffOutput       string
-	ApplyOutput      string
+
+	// HelmfileVersion is the version number or the semver version range for the helmfile version to use.
+	// Unlike helmfile_release_set, `version` is the chart version for helmfile_release so we need a dedicated field.
+	HelmfileVersion      string
+	HelmVersion          string
+	HelmDiffVersion      string
+	EnvironmentVariables map[string]interface{}
+
+	KubectlVersion   string
+	KustomizeVersion string
+	HelmPlugins      map[string]interface{}
+	Repositories     []Repository
+
+	Labels             map[string]interface{}
+	Needs              []string
+	CreateNamespace    bool
+	Installed          bool
+	Hooks              []Hook
+	PostRenderer       string
+	DisableValidation  bool
+	Secrets            []string
+	Set                []SetValue
+	SetString          []SetValue
+	MissingFileHandler string
+	HistoryMax         int
+
+	// JSONPatches, StrategicMergePatches and Transformers are JSON-encoded chartify transformations
+	JSONPatches           []string
+	StrategicMergePatches []string
+	Transformers          []string
+	Dependencies          []Dependency
+
+	DiffOutput  string
+	ApplyOutput string
 }
 
 func NewRelease(d ResourceRead) *Release {
@@ -42,7 +114,318 @@ func NewRelease(d ResourceRead) *Release {
 	f.Kubecontext = d.Get(KeyKubecontext).(string)
 	f.Bin = d.Get(KeyBin).(string)
 	f.HelmBin = d.Get(KeyHelmBin).(string)
+	f.HelmfileVersion = d.Get(KeyHelmfileVersion).(string)
+	f.HelmVersion = d.Get(KeyHelmVersion).(string)
+	f.HelmDiffVersion = d.Get(KeyHelmDiffVersion).(string)
+	if environmentVariables := d.Get(KeyEnvironmentVariables); environmentVariables != nil {
+		f.EnvironmentVariables = environmentVariables.(map[string]interface{})
+	}
+	f.KubectlVersion = d.Get(KeyKubectlVersion).(string)
+	f.KustomizeVersion = d.Get(KeyKustomizeVersion).(string)
+	if helmPlugins := d.Get(KeyHelmPlugins); helmPlugins != nil {
+		f.HelmPlugins = helmPlugins.(map[string]interface{})
+	}
+	if repos := d.Get(KeyRepository); repos != nil {
+		for _, r := range repos.([]interface{}) {
+			m := r.(map[string]interface{})
+
+			f.Repositories = append(f.Repositories, Repository{
+				Name:     m[KeyName].(string),
+				URL:      m[KeyURL].(string),
+				OCI:      m[KeyOCI].(bool),
+				Username: Sensitive(m[KeyUsername].(string)),
+				Password: Sensitive(m[KeyPassword].(string)),
+				CAFile:   m[KeyCAFile].(string),
+				CertFile: m[KeyCertFile].(string),
+				KeyFile:  m[KeyKeyFile].(string),
+			})
+		}
+	}
+	if labels := d.Get(KeyLabels); labels != nil {
+		f.Labels = labels.(map[string]interface{})
+	}
+	f.Needs = getStrings(d, KeyNeeds)
+	f.CreateNamespace = d.Get(KeyCreateNamespace).(bool)
+	f.Installed = d.Get(KeyInstalled).(bool)
+	if hooks := d.Get(KeyHook); hooks != nil {
+		for _, h := range hooks.([]interface{}) {
+			m := h.(map[string]interface{})
+
+			f.Hooks = append(f.Hooks, Hook{
+				Events:   toStrings(m[KeyEvents]),
+				ShowLogs: m[KeyShowLogs].(bool),
+				Command:  m[KeyCommand].(string),
+				Args:     toStrings(m[KeyArgs]),
+			})
+		}
+	}
+	f.PostRenderer = d.Get(KeyPostRenderer).(string)
+	f.DisableValidation = d.Get(KeyDisableValidation).(bool)
+	f.Secrets = getStrings(d, KeySecrets)
+	f.Set = getSetValues(d, KeySet)
+	f.SetString = getSetValues(d, KeySetString)
+	f.MissingFileHandler = d.Get(KeyMissingFileHandler).(string)
+	f.HistoryMax = d.Get(KeyHistoryMax).(int)
+	f.JSONPatches = getStrings(d, KeyJSONPatches)
+	f.StrategicMergePatches = getStrings(d, KeyStrategicMergePatches)
+	f.Transformers = getStrings(d, KeyTransformers)
+	if deps := d.Get(KeyDependency); deps != nil {
+		for _, dep := range deps.([]interface{}) {
+			m := dep.(map[string]interface{})
+
+			f.Dependencies = append(f.Dependencies, Dependency{
+				Chart:   m[KeyChart].(string),
+				Version: m[KeyVersion].(string),
+				Alias:   m[KeyAlias].(string),
+			})
+		}
+	}
 	f.DiffOutput = d.Get(KeyDiffOutput).(string)
 	f.ApplyOutput = d.Get(KeyApplyOutput).(string)
 	return &f
 }
+
+// renderRepositories returns the `repositories` section of the helmfile.yaml for the release,
+// along with environment variables that hold credentials for the repositories.
+//
+// Credentials are referenced from the helmfile.yaml via `requiredEnv`, so that they never end up in
+// the temporary helmfile.yaml written to the working directory nor in debug logs.
+func renderRepositories(repos []Repository) ([]interface{}, map[string]Sensitive) {
+	var rendered []interface{}
+
+	env := map[string]Sensitive{}
+
+	for i, r := range repos {
+		repo := map[string]interface{}{
+			"name": r.Name,
+			"url":  r.URL,
+		}
+
+		if r.OCI {
+			repo["oci"] = true
+		}
+
+		for _, c := range []struct {
+			key   string
+			value Sensitive
+		}{
+			{"username", r.Username},
+			{"password", r.Password},
+		} {
+			if c.value == "" {
+				continue
+			}
+
+			name := fmt.Sprintf("HELMFILE_RELEASE_REPOSITORY_%d_%s", i, strings.ToUpper(c.key))
+			env[name] = c.value
+			repo[c.key] = fmt.Sprintf("{{ requiredEnv `%s` }}", name)
+		}
+
+		for k, v := range map[string]string{
+			"caFile":   r.CAFile,
+			"certFile": r.CertFile,
+			"keyFile":  r.KeyFile,
+		} {
+			if v != "" {
+				repo[k] = v
+			}
+		}
+
+		rendered = append(rendered, repo)
+	}
+
+	return rendered, env
+}
+
+func toStrings(v interface{}) []string {
+	var ss []string
+
+	if v == nil {
+		return ss
+	}
+
+	for _, i := range v.([]interface{}) {
+		ss = append(ss, i.(string))
+	}
+
+	return ss
+}
+
+func getStrings(d ResourceRead, key string) []string {
+	return toStrings(d.Get(key))
+}
+
+func getSetValues(d ResourceRead, key string) []SetValue {
+	var vs []SetValue
+
+	v := d.Get(key)
+	if v == nil {
+		return vs
+	}
+
+	for _, i := range v.([]interface{}) {
+		m := i.(map[string]interface{})
+
+		vs = append(vs, SetValue{
+			Name:  m[KeyName].(string),
+			Value: m[KeyValue].(string),
+			File:  m[KeyFile].(string),
+		})
+	}
+
+	return vs
+}
+
+func renderSetValues(vs []SetValue) []interface{} {
+	var rendered []interface{}
+
+	for _, v := range vs {
+		item := map[string]interface{}{
+			"name": v.Name,
+		}
+
+		if v.File != "" {
+			item["file"] = v.File
+		} else {
+			item["value"] = v.Value
+		}
+
+		rendered = append(rendered, item)
+	}
+
+	return rendered
+}
+
+// renderOptionalReleaseFields adds fields of the helmfile release spec to the release.
+//
+// Each field is added only when it differs from helmfile's default,
+// so that the generated helmfile.yaml keeps working with older helmfile versions that don't support it.
+func renderOptionalReleaseFields(r *Release, release map[string]interface{}) {
+	if len(r.Labels) > 0 {
+		release["labels"] = r.Labels
+	}
+
+	if len(r.Needs) > 0 {
+		release["needs"] = r.Needs
+	}
+
+	if !r.CreateNamespace {
+		release["createNamespace"] = false
+	}
+
+	if !r.Installed {
+		release["installed"] = false
+	}
+
+	if len(r.Hooks) > 0 {
+		var hooks []interface{}
+
+		for _, h := range r.Hooks {
+			hook := map[string]interface{}{
+				"events":   h.Events,
+				"showlogs": h.ShowLogs,
+				"command":  h.Command,
+			}
+
+			if len(h.Args) > 0 {
+				hook["args"] = h.Args
+			}
+
+			hooks = append(hooks, hook)
+		}
+
+		release["hooks"] = hooks
+	}
+
+	if r.PostRenderer != "" {
+		release["postRenderer"] = r.PostRenderer
+	}
+
+	if r.DisableValidation {
+		release["disableValidation"] = true
+	}
+
+	if len(r.Secrets) > 0 {
+		release["secrets"] = r.Secrets
+	}
+
+	if len(r.Set) > 0 {
+		release["set"] = renderSetValues(r.Set)
+	}
+
+	if len(r.SetString) > 0 {
+		release["setString"] = renderSetValues(r.SetString)
+	}
+
+	if r.MissingFileHandler != "" {
+		release["missingFileHandler"] = r.MissingFileHandler
+	}
+
+	if r.HistoryMax > 0 {
+		release["historyMax"] = r.HistoryMax
+	}
+}
+
+func decodeJSONList(key string, items []string) ([]interface{}, error) {
+	var decoded []interface{}
+
+	for i, item := range items {
+		var v interface{}
+
+		if err := json.Unmarshal([]byte(item), &v); err != nil {
+			return nil, fmt.Errorf("decoding %s.%d as JSON: %w", key, i, err)
+		}
+
+		decoded = append(decoded, v)
+	}
+
+	return decoded, nil
+}
+
+// renderChartifyFields adds chartify transformations to the release.
+// As they are part of the generated helmfile.yaml, any change to them is reflected to the key of the helmfile-diff cache.
+func renderChartifyFields(r *Release, release map[string]interface{}) error {
+	for _, f := range []struct {
+		key, field string
+		items      []string
+	}{
+		{KeyJSONPatches, "jsonPatches", r.JSONPatches},
+		{KeyStrategicMergePatches, "strategicMergePatches", r.StrategicMergePatches},
+		{KeyTransformers, "transformers", r.Transformers},
+	} {
+		if len(f.items) == 0 {
+			continue
+		}
+
+		decoded, err := decodeJSONList(f.key, f.items)
+		if err != nil {
+			return err
+		}
+
+		release[f.field] = decoded
+	}
+
+	if len(r.Dependencies) > 0 {
+		var deps []interface{}
+
+		for _, d := range r.Dependencies {
+			dep := map[string]interface{}{
+				"chart": d.Chart,
+			}
+
+			if d.Version != "" {
+				dep["version"] = d.Version
+			}
+
+			if d.Alias != "" {
+				dep["alias"] = d.Alias
+			}
+
+			deps = append(deps, dep)
+		}
+
+		release["dependencies"] = deps
+	}
+
+	return nil
+}
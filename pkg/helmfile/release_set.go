@@ -3,6 +3,7 @@ package helmfile
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"fmt"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
@@ -14,6 +15,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver"
 )
@@ -36,8 +38,14 @@ type ReleaseSet struct {
 	Selectors []interface{}
 
 	EnvironmentVariables map[string]interface{}
-	WorkingDirectory     string
-	ReleasesValues       map[string]interface{}
+
+	// SensitiveEnvironmentVariables is the map of environment variables passed to helmfile, whose values are never logged.
+	// It's used to pass credentials like chart repository passwords, which are referenced from helmfile.yaml via `requiredEnv`
+	// so that they are never written to the temporary helmfile.yaml on disk.
+	SensitiveEnvironmentVariables map[string]Sensitive
+
+	WorkingDirectory string
+	ReleasesValues   map[string]interface{}
 
 	// Kubeconfig is the file path to kubeconfig which is set to the KUBECONFIG environment variable on running helmfile
 	Kubeconfig string
@@ -51,6 +59,30 @@ type ReleaseSet struct {
 	HelmVersion     string
 	HelmDiffVersion string
 
+	// KubectlVersion is the version number or the semver version range for the kubectl version to install.
+	// kubectl is used by helmfile's chartify integration.
+	KubectlVersion string
+
+	// KustomizeVersion is the version number or the semver version range for the kustomize version to install.
+	// kustomize is used by helmfile to build kustomizations and to apply strategicMergePatches.
+	KustomizeVersion string
+
+	// LocalChartHash is the content hash of the local chart directory used by the release set.
+	// It's a part of the key of the helmfile-diff cache, as `helmfile build` output doesn't change on local chart edits.
+	LocalChartHash string
+
+	// HelmPlugins is the map of helm plugin names to versions or sources of the plugins to be installed by the provider.
+	// helm-diff is always installed in addition to these, as helmfile depends on it.
+	HelmPlugins map[string]interface{}
+
+	// ShoalSyncTimeout is the maximum duration to wait for shoal to install helm, helmfile and helm plugins.
+	// Defaults to DefaultShoalSyncTimeout when zero.
+	ShoalSyncTimeout time.Duration
+
+	// BinaryCacheDir is the directory that shoal installs binaries and helm plugins into.
+	// Defaults to `.shoal` in the current working directory when empty.
+	BinaryCacheDir string
+
 	// SkipDiffOnMissingFiles is the list of local files. Any file contained in the list but missing on the file system
 	// result in the provider to skip running `helmfile-diff`. Use with Terraform's `depends_on`, so that
 	// you can let another dependent Terraform resource to created required files like kubeconfig or Helmfile values
@@ -58,6 +90,29 @@ type ReleaseSet struct {
 	//
 	// See https://github.com/mumoshu/terraform-provider-helmfile/issues/38 for more information on expected use-cases.
 	SkipDiffOnMissingFiles []string
+
+	// AuditLog is the path to the JSONL file that records every helmfile command changing the cluster.
+	// Nothing is recorded when empty.
+	AuditLog string
+
+	// Kubecontext is the kube context of the release of helmfile_release, which is recorded in the audit log.
+	// The audit log falls back to helmDefaults.kubeContext in the content and then the current context of the kubeconfig when empty.
+	Kubecontext string
+
+	// Context cancels helmfile and other commands run for the release set when done.
+	// Defaults to context.Background() when nil.
+	Context context.Context
+
+	// Logger receives log messages for the release set. Defaults to the standard logger when nil.
+	Logger Logger
+}
+
+func (fs *ReleaseSet) context() context.Context {
+	if fs.Context == nil {
+		return context.Background()
+	}
+
+	return fs.Context
 }
 
 func NewReleaseSet(d ResourceRead) (*ReleaseSet, error) {
@@ -113,6 +168,18 @@ func NewReleaseSet(d ResourceRead) (*ReleaseSet, error) {
 	f.HelmVersion = d.Get(KeyHelmVersion).(string)
 	f.HelmDiffVersion = d.Get(KeyHelmDiffVersion).(string)
 
+	if v := d.Get(KeyKubectlVersion); v != nil {
+		f.KubectlVersion = v.(string)
+	}
+
+	if v := d.Get(KeyKustomizeVersion); v != nil {
+		f.KustomizeVersion = v.(string)
+	}
+
+	if helmPlugins := d.Get(KeyHelmPlugins); helmPlugins != nil {
+		f.HelmPlugins = helmPlugins.(map[string]interface{})
+	}
+
 	logf("Printing raw working directory for %q: %s", d.Id(), f.WorkingDirectory)
 
 	if environmentVariables := d.Get(KeyEnvironmentVariables); environmentVariables != nil {
@@ -126,6 +193,17 @@ func NewReleaseSet(d ResourceRead) (*ReleaseSet, error) {
 }
 
 func NewCommandWithKubeconfig(fs *ReleaseSet, args ...string) (*exec.Cmd, error) {
+	return newCommand(fs, true, args...)
+}
+
+// newCommandWithoutCluster returns the helmfile command that never accesses the cluster, like `helmfile template`.
+// Unlike NewCommandWithKubeconfig, the command can be run without kubeconfig,
+// so that the diff can be computed offline before the cluster is created.
+func newCommandWithoutCluster(fs *ReleaseSet, args ...string) (*exec.Cmd, error) {
+	return newCommand(fs, false, args...)
+}
+
+func newCommand(fs *ReleaseSet, requireKubeconfig bool, args ...string) (*exec.Cmd, error) {
 	if fs.WorkingDirectory != "" {
 		if err := os.MkdirAll(fs.WorkingDirectory, 0755); err != nil {
 			return nil, fmt.Errorf("creating working directory %q: %w", fs.WorkingDirectory, err)
@@ -145,13 +223,13 @@ func NewCommandWithKubeconfig(fs *ReleaseSet, args ...string) (*exec.Cmd, error)
 		"--no-color",
 	}
 
-	helmfileBin, helmBin, err := prepareBinaries(fs)
+	bins, err := prepareBinaries(fs)
 	if err != nil {
 		return nil, err
 	}
 
-	if *helmBin != "" {
-		flags = append(flags, "--helm-binary", *helmBin)
+	if bins.Helm != "" {
+		flags = append(flags, "--helm-binary", bins.Helm)
 	}
 
 	if fs.Environment != "" {
@@ -194,24 +272,42 @@ func NewCommandWithKubeconfig(fs *ReleaseSet, args ...string) (*exec.Cmd, error)
 
 	flags = append(flags, args...)
 
-	logf("Running helmfile %s on %+v", strings.Join(flags, " "), *fs)
+	fs.logf("Running helmfile %s on %+v", strings.Join(flags, " "), *fs)
 
-	cmd := exec.Command(*helmfileBin, flags...)
+	cmd := exec.CommandContext(fs.context(), bins.Helmfile, flags...)
 	cmd.Dir = fs.WorkingDirectory
-	cmd.Env = append(os.Environ(), readEnvironmentVariables(fs.EnvironmentVariables, "KUBECONFIG")...)
+	cmd.Env = append(os.Environ(), bins.Env...)
+	cmd.Env = append(cmd.Env, readEnvironmentVariables(fs.EnvironmentVariables, "KUBECONFIG")...)
 
-	if kubeconfig, err := getKubeconfig(fs); err != nil {
-		return nil, fmt.Errorf("creating command: %w", err)
-	} else if *kubeconfig != "" {
-		cmd.Env = append(cmd.Env, "KUBECONFIG="+*kubeconfig)
-	} else {
-		return nil, fmt.Errorf("[BUG] NewCommandWithKubeconfig must not be called with empty kubeconfig path. args = %s", strings.Join(args, " "))
+	for k, v := range fs.SensitiveEnvironmentVariables {
+		cmd.Env = append(cmd.Env, k+"="+string(v))
 	}
 
-	logf("[DEBUG] Generated command: wd = %s, args = %s", fs.WorkingDirectory, strings.Join(cmd.Args, " "))
+	if requireKubeconfig || hasKubeconfig(fs) {
+		if kubeconfig, err := getKubeconfig(fs); err != nil {
+			return nil, fmt.Errorf("creating command: %w", err)
+		} else if *kubeconfig != "" {
+			cmd.Env = append(cmd.Env, "KUBECONFIG="+*kubeconfig)
+		} else {
+			return nil, fmt.Errorf("[BUG] NewCommandWithKubeconfig must not be called with empty kubeconfig path. args = %s", strings.Join(args, " "))
+		}
+	}
+
+	fs.logf("[DEBUG] Generated command: wd = %s, args = %s", fs.WorkingDirectory, strings.Join(cmd.Args, " "))
 	return cmd, nil
 }
 
+// hasKubeconfig returns true when the kubeconfig path is set to either kubeconfig or environment_variables.KUBECONFIG
+func hasKubeconfig(fs *ReleaseSet) bool {
+	if fs.Kubeconfig != "" {
+		return true
+	}
+
+	v, _ := fs.EnvironmentVariables["KUBECONFIG"].(string)
+
+	return v != ""
+}
+
 func getKubeconfig(fs *ReleaseSet) (*string, error) {
 	var rel string
 
@@ -241,8 +337,25 @@ func getKubeconfig(fs *ReleaseSet) (*string, error) {
 	return &abs, nil
 }
 
-func CreateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) error {
-	logf("[DEBUG] Creating release set resource...")
+// CreateReleaseSet runs helmfile-apply to install releases.
+// opts need to be the ones given to DiffReleaseSet on plan, which are used to verify the diff before apply.
+func CreateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite, opts ...DiffOption) error {
+	fs.logf("[DEBUG] Creating release set resource...")
+
+	var diffConf DiffConfig
+	for _, o := range opts {
+		o(&diffConf)
+	}
+
+	// Versions are verified before apply, so that a version mismatch never leaves the cluster changed
+	// without the release set recorded in the state
+	if err := recordResolvedVersions(fs, d, true); err != nil {
+		return err
+	}
+
+	if err := verifyDiffBeforeApply(ctx, fs, d, diffConf); err != nil {
+		return err
+	}
 
 	diffFile, err := getDiffFile(ctx, fs)
 	if err != nil {
@@ -252,7 +365,7 @@ func CreateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 	defer func() {
 		if _, err := os.Stat(diffFile); err == nil {
 			if err := os.Remove(diffFile); err != nil {
-				logf("Failed cleaning diff file: %v", err)
+				fs.logf("Failed cleaning diff file: %v", err)
 			}
 		}
 	}()
@@ -284,8 +397,7 @@ func CreateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 	mutexKV.Lock(fs.WorkingDirectory)
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
-	state := NewState()
-	st, err := runCommand(ctx, cmd, state, false)
+	st, err := runMutatingCommand(ctx, fs, d, cmd)
 	if err != nil {
 		return fmt.Errorf("running helmfile-apply: %w", err)
 	}
@@ -297,7 +409,7 @@ func CreateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 }
 
 func ReadReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) error {
-	logf("[DEBUG] Reading release set resource...")
+	fs.logf("[DEBUG] Reading release set resource...")
 
 	// We treat diff_output as always empty, to show `helmfile diff` output as a complete diff,
 	// rather than a diff of diffs.
@@ -312,10 +424,12 @@ func ReadReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) error
 	// StateFunc is called after Read and CustomizeDiff, which results in terraform showing diff of
 	// an empty string against an empty string, which is ovbiously not what we want.
 	d.Set(KeyDiffOutput, "")
+	d.Set(KeyDiffSHA256, "")
+	d.Set(KeyDestructiveChanges, []string{})
 	d.Set(KeyApplyOutput, "")
 
 	if fs.Kubeconfig == "" {
-		logf("Skipping helmfile-build due to that kubeconfig is empty, which means that this operation has been called on a helmfile resource that depends on in-existent resource")
+		fs.logf("Skipping helmfile-build due to that kubeconfig is empty, which means that this operation has been called on a helmfile resource that depends on in-existent resource")
 
 		return nil
 	}
@@ -324,7 +438,7 @@ func ReadReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) error
 	// to make sure any error in helmfile.yaml before successful apply is shown to the user.
 	_, err := runBuild(ctx, fs)
 	if err != nil {
-		logf("[DEBUG] Build error detected: %v", err)
+		fs.logf("[DEBUG] Build error detected: %v", err)
 
 		return nil
 	}
@@ -341,7 +455,7 @@ func runBuild(ctx *sdk.Context, fs *ReleaseSet, flags ...string) (*State, error)
 
 	args = append(args, flags...)
 
-	cmd, err := NewCommandWithKubeconfig(fs, args...)
+	cmd, err := newCommandWithoutCluster(fs, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -351,8 +465,7 @@ func runBuild(ctx *sdk.Context, fs *ReleaseSet, flags ...string) (*State, error)
 	mutexKV.Lock(fs.WorkingDirectory)
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
-	state := NewState()
-	return runCommand(ctx, cmd, state, false)
+	return runCommandWithFullOutput(ctx, fs, cmd, false)
 }
 
 func getHelmfileVersion(ctx *sdk.Context, fs *ReleaseSet) (*semver.Version, error) {
@@ -360,7 +473,7 @@ func getHelmfileVersion(ctx *sdk.Context, fs *ReleaseSet) (*semver.Version, erro
 		"version",
 	}
 
-	cmd, err := NewCommandWithKubeconfig(fs, args...)
+	cmd, err := newCommandWithoutCluster(fs, args...)
 	if err != nil {
 		return nil, fmt.Errorf("creating command: %w", err)
 	}
@@ -371,7 +484,7 @@ func getHelmfileVersion(ctx *sdk.Context, fs *ReleaseSet) (*semver.Version, erro
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
 	state := NewState()
-	st, err := runCommand(ctx, cmd, state, false)
+	st, err := runCommand(ctx, fs, cmd, state, false)
 	if err != nil {
 		return nil, fmt.Errorf("running command: %w", err)
 	}
@@ -383,18 +496,22 @@ func getHelmfileVersion(ctx *sdk.Context, fs *ReleaseSet) (*semver.Version, erro
 	v, err := semver.NewVersion(versionPart)
 
 	if err != nil {
-		logf("Failed to parse %q as semver: %v", versionPart, err)
+		fs.logf("Failed to parse %q as semver: %v", versionPart, err)
 	}
 
 	return v, nil
 }
 
-func runTemplate(ctx *sdk.Context, fs *ReleaseSet) (*State, error) {
+// runTemplate runs `helmfile template` with the flags.
+// The whole output is kept, as it's returned by TemplateReleaseSet and hashed to key the helmfile-diff cache.
+func runTemplate(ctx *sdk.Context, fs *ReleaseSet, flags ...string) (*State, error) {
 	args := []string{
 		"template",
 	}
 
-	cmd, err := NewCommandWithKubeconfig(fs, args...)
+	args = append(args, flags...)
+
+	cmd, err := newCommandWithoutCluster(fs, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -404,14 +521,51 @@ func runTemplate(ctx *sdk.Context, fs *ReleaseSet) (*State, error) {
 	mutexKV.Lock(fs.WorkingDirectory)
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
-	state := NewState()
-	return runCommand(ctx, cmd, state, false)
+	return runCommandWithFullOutput(ctx, fs, cmd, false)
+}
+
+// TemplateReleaseSet runs `helmfile template` and returns the rendered manifests
+func TemplateReleaseSet(ctx *sdk.Context, fs *ReleaseSet) (string, error) {
+	fs.logf("[DEBUG] Rendering release set...")
+
+	state, err := runTemplate(ctx, fs)
+	if err != nil {
+		return "", fmt.Errorf("running helmfile template: %w", err)
+	}
+
+	return state.Output, nil
+}
+
+// BuildReleaseSet runs `helmfile build` and returns the helmfile state after all the templates and values are processed.
+// Values files are embedded into the output when embedValues is true.
+func BuildReleaseSet(ctx *sdk.Context, fs *ReleaseSet, embedValues bool) (string, error) {
+	fs.logf("[DEBUG] Building release set...")
+
+	var flags []string
+
+	if embedValues {
+		flags = append(flags, "--embed-values")
+	}
+
+	state, err := runBuild(ctx, fs, flags...)
+	if err != nil {
+		return "", fmt.Errorf("running helmfile build: %w", err)
+	}
+
+	return state.Output, nil
 }
 
 type DiffConfig struct {
-	DryRun           bool
+	// DryRun computes the diff without accessing the cluster, as if none of the releases were installed.
+	// See runOfflineDiff for details.
+	DryRun bool
+
+	// Kubeconfig overrides the kubeconfig of the release set
 	Kubeconfig       string
 	MaxDiffOutputLen int
+
+	// fullContext makes helm-diff print whole manifests rather than 3 lines around changes
+	fullContext bool
 }
 
 type DiffOption func(*DiffConfig)
@@ -423,20 +577,24 @@ func WithDiffConfig(c DiffConfig) DiffOption {
 }
 
 func runDiff(ctx *sdk.Context, fs *ReleaseSet, conf DiffConfig) (*State, error) {
+	if conf.DryRun {
+		return runOfflineDiff(ctx, fs)
+	}
+
 	args := []string{
 		"diff",
 		"--concurrency", strconv.Itoa(fs.Concurrency),
 		"--detailed-exitcode",
 		"--suppress-secrets",
-		"--context", "3",
 	}
 
-	for k, v := range fs.ReleasesValues {
-		args = append(args, "--set", fmt.Sprintf("%s=%s", k, v))
+	// helm-diff prints whole manifests without --context
+	if !conf.fullContext {
+		args = append(args, "--context", "3")
 	}
 
-	if conf.DryRun {
-		args = append(args, "--dry-run")
+	for k, v := range fs.ReleasesValues {
+		args = append(args, "--set", fmt.Sprintf("%s=%s", k, v))
 	}
 
 	cmd, err := NewCommandWithKubeconfig(fs, args...)
@@ -449,7 +607,12 @@ func runDiff(ctx *sdk.Context, fs *ReleaseSet, conf DiffConfig) (*State, error)
 	// so that helmfile-diff output becomes stables and terraform plan doesn't break.
 	// See https://github.com/roboll/helmfile/pull/1622
 
-	hash, err := HashObject(fs)
+	// Context and Logger are excluded as they differ across provider runs.
+	hashed := *fs
+	hashed.Context = nil
+	hashed.Logger = nil
+
+	hash, err := HashObject(&hashed)
 	if err != nil {
 		return nil, xerrors.Errorf("computing hash of object: %w", err)
 	}
@@ -483,8 +646,8 @@ func runDiff(ctx *sdk.Context, fs *ReleaseSet, conf DiffConfig) (*State, error)
 	mutexKV.Lock(fs.WorkingDirectory)
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
-	state := NewState()
-	diff, err := runCommand(ctx, cmd, state, true)
+	// The whole output is needed as diff_sha256 and destructive_changes are computed from it
+	diff, err := runCommandWithFullOutput(ctx, fs, cmd, true)
 	if err != nil {
 		return nil, fmt.Errorf("running command: %w", err)
 	}
@@ -528,7 +691,7 @@ func getDiffFile(ctx *sdk.Context, fs *ReleaseSet) (string, error) {
 	var determinisiticOutput string
 
 	if helmfileVersion != nil && gte126.Check(helmfileVersion) {
-		logf("Detected Helmfile version greater than 0.126.0(=%s). Using `helmfile build --embed-values` to compute the unique ID of the desired state.", helmfileVersion)
+		fs.logf("Detected Helmfile version greater than 0.126.0(=%s). Using `helmfile build --embed-values` to compute the unique ID of the desired state.", helmfileVersion)
 		build, err := runBuild(ctx, fs, "--embed-values")
 		if err != nil {
 			return "", fmt.Errorf("running helmfile build: %w", err)
@@ -558,8 +721,15 @@ func getDiffFile(ctx *sdk.Context, fs *ReleaseSet) (string, error) {
 		}
 	}
 
+	binsKey, err := binariesKey(fs)
+	if err != nil {
+		return "", err
+	}
+
 	hash := sha256.New()
 	hash.Write([]byte(determinisiticOutput))
+	hash.Write([]byte(binsKey))
+	hash.Write([]byte(fs.LocalChartHash))
 	diffFile := filepath.Join(".terraform", "helmfile", fmt.Sprintf("diff-%x", hash.Sum(nil)))
 
 	return diffFile, nil
@@ -575,7 +745,7 @@ func writeDiffFile(ctx *sdk.Context, fs *ReleaseSet, content string) error {
 		return fmt.Errorf("creating directory for diff file %s: %v", diffFile, err)
 	}
 
-	logf("Writing diff file to %s", diffFile)
+	fs.logf("Writing diff file to %s", diffFile)
 
 	if err := ioutil.WriteFile(diffFile, []byte(content), 0644); err != nil {
 		return fmt.Errorf("writing diff to %s: %v", diffFile, err)
@@ -596,7 +766,7 @@ func readDiffFile(ctx *sdk.Context, fs *ReleaseSet) (string, error) {
 	}
 
 	if len(bs) > 0 {
-		logf("[DEBUG] Skipped running helmfile-diff on resource because we already have changes on diff: %+v", *fs)
+		fs.logf("[DEBUG] Skipped running helmfile-diff on resource because we already have changes on diff: %+v", *fs)
 	}
 
 	return string(bs), nil
@@ -619,18 +789,24 @@ func readDiffFile(ctx *sdk.Context, fs *ReleaseSet) (string, error) {
 //   a lot of text
 //   ...
 func DiffReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite, opts ...DiffOption) (string, error) {
-	logf("[DEBUG] Detecting changes on release set resource...")
+	fs.logf("[DEBUG] Detecting changes on release set resource...")
 
 	var diffConf DiffConfig
 	for _, o := range opts {
 		o(&diffConf)
 	}
 
+	// Recording resolved versions here makes `terraform plan` show changes whenever e.g. a semver range in `version`
+	// starts resolving to another version.
+	if err := recordResolvedVersions(fs, d, false); err != nil {
+		return "", err
+	}
+
 	diff, err := readDiffFile(ctx, fs)
 	if err != nil {
 		state, err := runDiff(ctx, fs, diffConf)
 		if err != nil {
-			logf("[DEBUG] Diff error detected: %v", err)
+			fs.logf("[DEBUG] Diff error detected: %v", err)
 
 			// Make sure errors due to the latest `helmfile diff` run is shown to the user
 			// d.SetNew(KeyError, err.Error())
@@ -669,10 +845,30 @@ func DiffReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite, opts
 		}
 	}
 
+	// destructive_changes is updated even when there are no changes,
+	// so that the ones detected by the previous plan don't remain after they're gone.
+	fullDiff := func() (string, error) {
+		conf := diffConf
+		conf.fullContext = true
+
+		state, err := runDiff(ctx, fs, conf)
+		if err != nil {
+			return "", fmt.Errorf("running helmfile diff: %w", err)
+		}
+
+		return state.Output, nil
+	}
+
+	if err := checkDestructiveChanges(fs, d, diff, fullDiff); err != nil {
+		return "", err
+	}
+
 	// Executing d.Set(KeyDiffOutput, "") still internally records the update to the state
 	// even if d.Get(KeyDiffOutput) is already "", which breaks our acceptance test.
 	// Guard against that here.
 	if diff != "" {
+		d.Set(KeyDiffSHA256, diffSHA256(diff))
+
 		maxDiffOutputLen := diffConf.MaxDiffOutputLen
 
 		if maxDiffOutputLen == 0 {
@@ -682,7 +878,7 @@ func DiffReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite, opts
 		}
 
 		notice := "...\n" +
-			"helmfile-diff output was too long, and therefore snipped.\n" +
+			diffSnippedNotice + "\n" +
 			fmt.Sprintf("Set max_diff_output_len in the provider config, which is currently %d, to a larger value to see more.", maxDiffOutputLen)
 		noticeLen := len(notice)
 
@@ -777,7 +973,14 @@ func removeNondeterministicBuildLogLines(s string) (string, error) {
 	return buf.String(), nil
 }
 
-func UpdateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) error {
+// UpdateReleaseSet runs helmfile-apply to apply the planned changes.
+// opts need to be the ones given to DiffReleaseSet on plan, which are used to verify the diff before apply.
+func UpdateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite, opts ...DiffOption) error {
+	var diffConf DiffConfig
+	for _, o := range opts {
+		o(&diffConf)
+	}
+
 	diffFile, err := getDiffFile(ctx, fs)
 	if err != nil {
 		return err
@@ -786,15 +989,19 @@ func UpdateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 	defer func() {
 		if _, err := os.Stat(diffFile); err == nil {
 			if err := os.Remove(diffFile); err != nil {
-				logf("Failed cleaning diff file: %v", err)
+				fs.logf("Failed cleaning diff file: %v", err)
 			}
 		}
 	}()
 
-	logf("[DEBUG] Updating release set resource...")
+	fs.logf("[DEBUG] Updating release set resource...")
 
 	d.Set(KeyDirty, false)
 
+	if err := recordResolvedVersions(fs, d, true); err != nil {
+		return err
+	}
+
 	var plannedDiffOutput string
 	if v := d.Get(KeyDiffOutput); v != nil {
 		plannedDiffOutput = v.(string)
@@ -804,6 +1011,10 @@ func UpdateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 		return nil
 	}
 
+	if err := verifyDiffBeforeApply(ctx, fs, d, diffConf); err != nil {
+		return err
+	}
+
 	args := []string{
 		"apply",
 		"--concurrency", strconv.Itoa(fs.Concurrency),
@@ -831,8 +1042,7 @@ func UpdateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 	mutexKV.Lock(fs.WorkingDirectory)
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
-	state := NewState()
-	st, err := runCommand(ctx, cmd, state, false)
+	st, err := runMutatingCommand(ctx, fs, d, cmd)
 	if err != nil {
 		return err
 	}
@@ -843,7 +1053,7 @@ func UpdateReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 }
 
 func DeleteReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) error {
-	logf("[DEBUG] Deleting release set resource...")
+	fs.logf("[DEBUG] Deleting release set resource...")
 	cmd, err := NewCommandWithKubeconfig(fs, "destroy")
 	if err != nil {
 		return err
@@ -854,8 +1064,7 @@ func DeleteReleaseSet(ctx *sdk.Context, fs *ReleaseSet, d ResourceReadWrite) err
 	mutexKV.Lock(fs.WorkingDirectory)
 	defer mutexKV.Unlock(fs.WorkingDirectory)
 
-	state := NewState()
-	_, err = runCommand(ctx, cmd, state, false)
+	_, err = runMutatingCommand(ctx, fs, d, cmd)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,111 @@
+package helmfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRenderRepositories(t *testing.T) {
+	repos := []Repository{
+		{Name: "sp", URL: "https://stefanprodan.github.io/podinfo"},
+		{Name: "private", URL: "registry.example.com/charts", OCI: true, Username: "user", Password: "secret", CAFile: "ca.crt"},
+	}
+
+	rendered, env := renderRepositories(repos)
+
+	bs, err := json.Marshal(rendered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `[{"name":"sp","url":"https://stefanprodan.github.io/podinfo"},` +
+		`{"caFile":"ca.crt","name":"private","oci":true,` +
+		"\"password\":\"{{ requiredEnv `HELMFILE_RELEASE_REPOSITORY_1_PASSWORD` }}\"," +
+		`"url":"registry.example.com/charts",` +
+		"\"username\":\"{{ requiredEnv `HELMFILE_RELEASE_REPOSITORY_1_USERNAME` }}\"}]"
+
+	if string(bs) != want {
+		t.Errorf("unexpected repositories:\nwant: %s\ngot:  %s", want, string(bs))
+	}
+
+	if got := string(env["HELMFILE_RELEASE_REPOSITORY_1_PASSWORD"]); got != "secret" {
+		t.Errorf("unexpected password env: %q", got)
+	}
+
+	if s := fmt.Sprintf("%+v", ReleaseSet{SensitiveEnvironmentVariables: env}); strings.Contains(s, "secret") {
+		t.Errorf("sensitive value leaked: %s", s)
+	}
+}
+
+func TestRenderOptionalReleaseFields(t *testing.T) {
+	r := &Release{
+		CreateNamespace: true,
+		Installed:       false,
+		Labels:          map[string]interface{}{"tier": "frontend"},
+		Needs:           []string{"kube-system/cert-manager"},
+		Hooks: []Hook{
+			{Events: []string{"prepare"}, Command: "echo", Args: []string{"hello"}},
+		},
+		Set:        []SetValue{{Name: "image.tag", Value: "1.0.0"}},
+		SetString:  []SetValue{{Name: "config", File: "config.txt"}},
+		HistoryMax: 10,
+	}
+
+	release := map[string]interface{}{}
+
+	renderOptionalReleaseFields(r, release)
+
+	bs, err := json.Marshal(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"historyMax":10,` +
+		`"hooks":[{"args":["hello"],"command":"echo","events":["prepare"],"showlogs":false}],` +
+		`"installed":false,` +
+		`"labels":{"tier":"frontend"},` +
+		`"needs":["kube-system/cert-manager"],` +
+		`"set":[{"name":"image.tag","value":"1.0.0"}],` +
+		`"setString":[{"file":"config.txt","name":"config"}]}`
+
+	if string(bs) != want {
+		t.Errorf("unexpected release:\nwant: %s\ngot:  %s", want, string(bs))
+	}
+}
+
+func TestRenderChartifyFields(t *testing.T) {
+	r := &Release{
+		JSONPatches: []string{
+			`{"target":{"kind":"Deployment","name":"myapp"},"patch":[{"op":"replace","path":"/spec/replicas","value":2}]}`,
+		},
+		StrategicMergePatches: []string{`"patches/sm.yaml"`},
+		Dependencies: []Dependency{
+			{Chart: "stable/envoy", Version: "1.9.0"},
+		},
+	}
+
+	release := map[string]interface{}{}
+
+	if err := renderChartifyFields(r, release); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := json.Marshal(release)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"dependencies":[{"chart":"stable/envoy","version":"1.9.0"}],` +
+		`"jsonPatches":[{"patch":[{"op":"replace","path":"/spec/replicas","value":2}],"target":{"kind":"Deployment","name":"myapp"}}],` +
+		`"strategicMergePatches":["patches/sm.yaml"]}`
+
+	if string(bs) != want {
+		t.Errorf("unexpected release:\nwant: %s\ngot:  %s", want, string(bs))
+	}
+
+	if err := renderChartifyFields(&Release{Transformers: []string{"not json"}}, release); err == nil {
+		t.Errorf("expected error for invalid JSON")
+	}
+}
@@ -1,11 +1,21 @@
 package helmfile
 
 import (
+	"context"
 	"fmt"
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 	"github.com/rs/xid"
+	"strconv"
+	"sync"
 )
 
+// KeyDryRun is the key of the attribute to compute the diff of embedded release sets without accessing the cluster
+const KeyDryRun = "dry_run"
+
+// KeyEmbeddedKey is the key of the attribute that identifies an embedded release set across plans
+const KeyEmbeddedKey = "key"
+
 func resourceHelmfileEmbeddingExample() *schema.Resource {
 	return &schema.Resource{
 		Create:        resourceHelmfileEmbeddingExampleCreate,
@@ -14,6 +24,22 @@ func resourceHelmfileEmbeddingExample() *schema.Resource {
 		Update:        resourceHelmfileEmbeddingExampleUpdate,
 		CustomizeDiff: resourceHelmfileEmbeddingExampleCustomizeDiff,
 		Schema: map[string]*schema.Schema{
+			KeyDryRun: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			KeyKubeconfig: {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "",
+			},
+			KeyParallelism: {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Default:      DefaultEmbeddedParallelism,
+				ValidateFunc: validation.IntAtLeast(1),
+			},
 			"embedded": {
 				Type:     schema.TypeList,
 				Optional: true,
@@ -23,46 +49,126 @@ func resourceHelmfileEmbeddingExample() *schema.Resource {
 				// rather than the actual planned value
 				Computed: true,
 				Elem: &schema.Resource{
-					Schema: ReleaseSetSchema,
+					Schema: embeddedReleaseSetSchema(),
 				},
 			},
 		},
 	}
 }
 
+// embeddedReleaseSetSchema returns the schema of an embedded entry, that is ReleaseSetSchema plus the key
+func embeddedReleaseSetSchema() map[string]*schema.Schema {
+	s := map[string]*schema.Schema{
+		KeyEmbeddedKey: {
+			Type:     schema.TypeString,
+			Required: true,
+		},
+		KeyEmbeddedNeeds: {
+			Type:     schema.TypeList,
+			Optional: true,
+			Elem: &schema.Schema{
+				Type: schema.TypeString,
+			},
+		},
+	}
+
+	for k, v := range ReleaseSetSchema {
+		// Policies are checked only for helmfile_release_set.
+		// Approved and verified diffs aren't supported as the diff of an embedded release set can be computed offline.
+		if k == KeyPolicy || k == KeyPolicyFiles || k == KeyPolicyWarnings || k == KeyApprovedDiffSHA256 || k == KeyVerifyPlanOnApply {
+			continue
+		}
+
+		s[k] = v
+	}
+
+	return s
+}
+
 func ExtractEmbeddedReleaseSetResources(data ResourceRead, attr string) ([]map[string]interface{}, error) {
+	d := data.Get(attr)
+	if d == nil {
+		return nil, fmt.Errorf("getting field: no attribute named %q found", attr)
+	}
+
+	return toEmbeddedReleaseSetResources(d), nil
+}
+
+func toEmbeddedReleaseSetResources(v interface{}) []map[string]interface{} {
 	var entries []map[string]interface{}
 
-	if d := data.Get(attr); d == nil {
-		return nil, fmt.Errorf("getting field: no attribute named %q found", attr)
-	} else {
-		ifs := d.([]interface{})
+	ifs, _ := v.([]interface{})
+
+	for _, i := range ifs {
+		entries = append(entries, i.(map[string]interface{}))
+	}
+
+	return entries
+}
 
-		for _, i := range ifs {
-			entries = append(entries, i.(map[string]interface{}))
+// keyEmbeddedReleaseSetResources wraps embedded entries in the configuration into resources identified by their keys,
+// so that entries are matched across plans even when they are reordered, added or removed.
+// Every entry needs the key, as falling back to the position would remap all the entries after a removed one.
+func keyEmbeddedReleaseSetResources(entries []map[string]interface{}) ([]*ResourceReadWriteEmbedded, error) {
+	for i, e := range entries {
+		if key, _ := e[KeyEmbeddedKey].(string); key == "" {
+			return nil, fmt.Errorf("validating embedded release sets: %s of the entry at index %d is missing", KeyEmbeddedKey, i)
 		}
 	}
 
-	return entries, nil
+	return keyRecordedEmbeddedReleaseSetResources(entries)
+}
+
+// keyRecordedEmbeddedReleaseSetResources is the same as keyEmbeddedReleaseSetResources but for entries recorded in the state.
+// Entries recorded before keys were required have no key, and are identified by their positions in the list.
+func keyRecordedEmbeddedReleaseSetResources(entries []map[string]interface{}) ([]*ResourceReadWriteEmbedded, error) {
+	var resources []*ResourceReadWriteEmbedded
+
+	seen := map[string]bool{}
+
+	for i, e := range entries {
+		key, _ := e[KeyEmbeddedKey].(string)
+		if key == "" {
+			key = strconv.Itoa(i)
+		}
+
+		if seen[key] {
+			return nil, fmt.Errorf("validating embedded release sets: duplicate key %q", key)
+		}
+
+		seen[key] = true
+
+		resources = append(resources, &ResourceReadWriteEmbedded{m: e, id: key})
+	}
+
+	return resources, nil
 }
 
-func resourceHelmfileEmbeddingExampleCreate(data *schema.ResourceData, i interface{}) error {
+func resourceHelmfileEmbeddingExampleCreate(data *schema.ResourceData, i interface{}) (finalErr error) {
 	embeddedResources, err := ExtractEmbeddedReleaseSetResources(data, "embedded")
 	if err != nil {
 		return err
 	}
 
-	for _, e := range embeddedResources {
-		fs := &ResourceReadWriteEmbedded{m: e}
+	resources, err := keyEmbeddedReleaseSetResources(embeddedResources)
+	if err != nil {
+		return err
+	}
 
-		rs, err := NewReleaseSet(fs)
+	parent := getEmbeddedParent(data)
+	sp := parent.startOperation(data.Id(), OperationCreate)
+	defer func() { sp.finish(finalErr) }()
+
+	err = runEmbedded(resources, parent.Parallelism, false, func(fs *ResourceReadWriteEmbedded) error {
+		rs, err := newEmbeddedReleaseSet(parent, fs, i)
 		if err != nil {
 			return err
 		}
 
-		if err := CreateReleaseSet(newContext(fs), rs, fs); err != nil {
-			return err
-		}
+		return CreateReleaseSet(newContext(fs), rs, fs, WithDiffConfig(embeddedDiffConfig(parent, i)))
+	})
+	if err != nil {
+		return err
 	}
 
 	// Note: If you missed marking new resource and setting the id, it may end up unintuitive tf error like:
@@ -82,84 +188,194 @@ func resourceHelmfileEmbeddingExampleCreate(data *schema.ResourceData, i interfa
 	return nil
 }
 
-func resourceHelmfileEmbeddingExampleDelete(data *schema.ResourceData, i interface{}) error {
+func resourceHelmfileEmbeddingExampleDelete(data *schema.ResourceData, i interface{}) (finalErr error) {
 	embeddedResources, err := ExtractEmbeddedReleaseSetResources(data, "embedded")
 	if err != nil {
 		return err
 	}
 
-	for _, e := range embeddedResources {
-		fs := &ResourceReadWriteEmbedded{m: e}
+	resources, err := keyRecordedEmbeddedReleaseSetResources(embeddedResources)
+	if err != nil {
+		return err
+	}
+
+	parent := getEmbeddedParent(data)
+	sp := parent.startOperation(data.Id(), OperationDelete)
+	defer func() { sp.finish(finalErr) }()
 
-		rs, err := NewReleaseSet(fs)
+	return runEmbedded(resources, parent.Parallelism, true, func(fs *ResourceReadWriteEmbedded) error {
+		rs, err := newEmbeddedReleaseSet(parent, fs, i)
 		if err != nil {
 			return err
 		}
 
-		if err := DeleteReleaseSet(newContext(fs), rs, fs); err != nil {
-			return err
-		}
-	}
-	return nil
+		return DeleteReleaseSet(newContext(fs), rs, fs)
+	})
 }
 
-func resourceHelmfileEmbeddingExampleRead(data *schema.ResourceData, i interface{}) error {
+func resourceHelmfileEmbeddingExampleRead(data *schema.ResourceData, i interface{}) (finalErr error) {
 	embeddedResources, err := ExtractEmbeddedReleaseSetResources(data, "embedded")
 	if err != nil {
 		return err
 	}
 
-	for _, e := range embeddedResources {
-		fs := &ResourceReadWriteEmbedded{m: e}
+	resources, err := keyRecordedEmbeddedReleaseSetResources(embeddedResources)
+	if err != nil {
+		return err
+	}
+
+	parent := getEmbeddedParent(data)
+	sp := parent.startOperation(data.Id(), OperationRead)
+	defer func() { sp.finish(finalErr) }()
 
-		rs, err := NewReleaseSet(fs)
+	return runEmbedded(resources, parent.Parallelism, false, func(fs *ResourceReadWriteEmbedded) error {
+		rs, err := newEmbeddedReleaseSet(parent, fs, i)
 		if err != nil {
 			return err
 		}
 
-		if err := ReadReleaseSet(newContext(fs), rs, fs); err != nil {
-			return err
-		}
-	}
-	return nil
+		return ReadReleaseSet(newContext(fs), rs, fs)
+	})
 }
 
-func resourceHelmfileEmbeddingExampleUpdate(data *schema.ResourceData, i interface{}) error {
-	embeddedResources, err := ExtractEmbeddedReleaseSetResources(data, "embedded")
+// resourceHelmfileEmbeddingExampleUpdate matches old and new embedded entries by their keys.
+// It destroys removed entries, creates added entries, and updates only the remaining entries whose diff isn't empty.
+func resourceHelmfileEmbeddingExampleUpdate(data *schema.ResourceData, i interface{}) (finalErr error) {
+	o, n := data.GetChange("embedded")
+
+	embeddedResources := toEmbeddedReleaseSetResources(n)
+
+	news, err := keyEmbeddedReleaseSetResources(embeddedResources)
 	if err != nil {
 		return err
 	}
 
-	for _, e := range embeddedResources {
-		fs := &ResourceReadWriteEmbedded{m: e}
+	olds, err := keyRecordedEmbeddedReleaseSetResources(adoptEmbeddedKeys(toEmbeddedReleaseSetResources(o), embeddedResources))
+	if err != nil {
+		return err
+	}
 
-		rs, err := NewReleaseSet(fs)
+	existing, removed := matchEmbeddedReleaseSetResources(olds, news)
+
+	parent := getEmbeddedParent(data)
+	sp := parent.startOperation(data.Id(), OperationUpdate)
+	defer func() { sp.finish(finalErr) }()
+
+	err = runEmbedded(removed, parent.Parallelism, true, func(fs *ResourceReadWriteEmbedded) error {
+		logf("Destroying embedded release set %q removed from the configuration", fs.Id())
+
+		rs, err := newEmbeddedReleaseSet(parent, fs, i)
 		if err != nil {
 			return err
 		}
 
-		if err := UpdateReleaseSet(newContext(fs), rs, fs); err != nil {
+		return DeleteReleaseSet(newContext(fs), rs, fs)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = runEmbedded(news, parent.Parallelism, false, func(fs *ResourceReadWriteEmbedded) error {
+		rs, err := newEmbeddedReleaseSet(parent, fs, i)
+		if err != nil {
 			return err
 		}
-	}
 
+		if !existing[fs.Id()] {
+			return CreateReleaseSet(newContext(fs), rs, fs, WithDiffConfig(embeddedDiffConfig(parent, i)))
+		}
+
+		if rs.DiffOutput == "" {
+			logf("Skipping update of embedded release set %q as it has no changes", fs.Id())
+
+			return nil
+		}
+
+		return UpdateReleaseSet(newContext(fs), rs, fs, WithDiffConfig(embeddedDiffConfig(parent, i)))
+	})
+
+	// Entries processed successfully are recorded even when others failed
 	data.Set("embedded", embeddedResources)
 
-	return nil
+	return err
+}
+
+// adoptEmbeddedKeys returns old entries whose missing keys are taken from the new entries at the same positions.
+// Entries recorded before keys were required are matched by their positions only once, so that adding keys to them
+// never destroys and recreates them.
+func adoptEmbeddedKeys(olds, news []map[string]interface{}) []map[string]interface{} {
+	var adopted []map[string]interface{}
+
+	for i, e := range olds {
+		if key, _ := e[KeyEmbeddedKey].(string); key == "" && i < len(news) {
+			c := map[string]interface{}{}
+
+			for k, v := range e {
+				c[k] = v
+			}
+
+			c[KeyEmbeddedKey] = news[i][KeyEmbeddedKey]
+
+			e = c
+		}
+
+		adopted = append(adopted, e)
+	}
+
+	return adopted
 }
 
-func resourceHelmfileEmbeddingExampleCustomizeDiff(resourceDiff *schema.ResourceDiff, i interface{}) error {
+// matchEmbeddedReleaseSetResources matches old and new entries by their keys.
+// It returns keys of the old entries, and the old entries removed from the new ones.
+func matchEmbeddedReleaseSetResources(olds, news []*ResourceReadWriteEmbedded) (map[string]bool, []*ResourceReadWriteEmbedded) {
+	existing := map[string]bool{}
+	desired := map[string]bool{}
+
+	for _, fs := range olds {
+		existing[fs.Id()] = true
+	}
+
+	for _, fs := range news {
+		desired[fs.Id()] = true
+	}
+
+	var removed []*ResourceReadWriteEmbedded
+
+	for _, fs := range olds {
+		if !desired[fs.Id()] {
+			removed = append(removed, fs)
+		}
+	}
+
+	return existing, removed
+}
+
+func resourceHelmfileEmbeddingExampleCustomizeDiff(resourceDiff *schema.ResourceDiff, i interface{}) (finalErr error) {
 	embeddedResources, err := ExtractEmbeddedReleaseSetResources(resourceDiff, "embedded")
 	if err != nil {
 		return err
 	}
 
-	var hasDiff bool
+	resources, err := keyEmbeddedReleaseSetResources(embeddedResources)
+	if err != nil {
+		return err
+	}
+
+	if err := validateEmbeddedNeeds(resources); err != nil {
+		return err
+	}
+
+	parent := getEmbeddedParent(resourceDiff)
+	sp := parent.startOperation(resourceDiff.Id(), OperationPlan)
+	defer func() { sp.finish(finalErr) }()
 
-	for _, e := range embeddedResources {
-		fs := &ResourceReadWriteEmbedded{m: e}
+	var (
+		mu      sync.Mutex
+		hasDiff bool
+	)
 
-		rs, err := NewReleaseSet(fs)
+	err = runEmbedded(resources, parent.Parallelism, false, func(fs *ResourceReadWriteEmbedded) error {
+		rs, err := newEmbeddedReleaseSet(parent, fs, i)
 		if err != nil {
 			return err
 		}
@@ -170,14 +386,21 @@ func resourceHelmfileEmbeddingExampleCustomizeDiff(resourceDiff *schema.Resource
 		//
 		// DryRun=false and Kubeconfig!="" should be set if the K8s cluster is already there and you have the kubeconfig to
 		// access the K8s API
-		diff, err := DiffReleaseSet(newContext(fs), rs, fs, WithDiffConfig(DiffConfig{DryRun: false, Kubeconfig: ""}))
+		diff, err := DiffReleaseSet(newContext(fs), rs, fs, WithDiffConfig(embeddedDiffConfig(parent, i)))
 		if err != nil {
 			return err
 		}
 
 		if diff != "" {
+			mu.Lock()
 			hasDiff = true
+			mu.Unlock()
 		}
+
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	if hasDiff {
@@ -188,3 +411,97 @@ func resourceHelmfileEmbeddingExampleCustomizeDiff(resourceDiff *schema.Resource
 
 	return nil
 }
+
+// embeddedParent is the configuration of the parent resource that applies to all the embedded release sets.
+// It's read once before processing embedded release sets concurrently.
+type embeddedParent struct {
+	DryRun      bool
+	Kubeconfig  string
+	Parallelism int
+
+	// Logger is the logger for the operation on the parent resource. Each embedded release set logs with its key added.
+	Logger *operationLogger
+
+	// Context carries the root span of the operation, which spans for embedded release sets are children of
+	Context context.Context
+}
+
+// startOperation sets the logger and the root span for the operation on the parent resource
+func (p *embeddedParent) startOperation(id, operation string) *span {
+	p.Logger = newOperationLogger("helmfile_embedding_example", id, operation)
+
+	var sp *span
+
+	p.Context, sp = startOperationSpan(context.Background(), p.Logger)
+
+	return sp
+}
+
+func getEmbeddedParent(d ResourceRead) embeddedParent {
+	var p embeddedParent
+
+	if v := d.Get(KeyDryRun); v != nil {
+		p.DryRun = v.(bool)
+	}
+
+	if v := d.Get(KeyKubeconfig); v != nil {
+		p.Kubeconfig = v.(string)
+	}
+
+	if v := d.Get(KeyParallelism); v != nil {
+		p.Parallelism = v.(int)
+	}
+
+	return p
+}
+
+// newEmbeddedReleaseSet creates the release set for an embedded entry,
+// with the provider configuration and the overrides from the parent resource applied.
+func newEmbeddedReleaseSet(parent embeddedParent, fs ResourceRead, meta interface{}) (*ReleaseSet, error) {
+	rs, err := NewReleaseSet(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	configureReleaseSet(meta, rs)
+
+	if parent.Logger != nil {
+		rs.Logger = parent.Logger.with("key", fs.Id())
+	}
+
+	rs.Context = parent.Context
+
+	if parent.Kubeconfig != "" {
+		rs.Kubeconfig = parent.Kubeconfig
+
+		// The parent's kubeconfig takes precedence over KUBECONFIG in environment_variables of the entry,
+		// which would otherwise conflict with it
+		if _, ok := rs.EnvironmentVariables["KUBECONFIG"]; ok {
+			envvars := map[string]interface{}{}
+
+			for k, v := range rs.EnvironmentVariables {
+				if k != "KUBECONFIG" {
+					envvars[k] = v
+				}
+			}
+
+			rs.EnvironmentVariables = envvars
+		}
+	}
+
+	return rs, nil
+}
+
+// embeddedDiffConfig returns the configuration for diffing embedded entries of the parent resource
+func embeddedDiffConfig(parent embeddedParent, meta interface{}) DiffConfig {
+	conf := DiffConfig{
+		DryRun:     parent.DryRun,
+		Kubeconfig: parent.Kubeconfig,
+	}
+
+	if p, ok := meta.(*ProviderInstance); ok && p != nil {
+		conf.MaxDiffOutputLen = p.MaxDiffOutputLen
+	}
+
+	return conf
+}
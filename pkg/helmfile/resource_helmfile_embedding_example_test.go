@@ -0,0 +1,152 @@
+package helmfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func embeddedIds(resources []*ResourceReadWriteEmbedded) []string {
+	var ids []string
+
+	for _, r := range resources {
+		ids = append(ids, r.Id())
+	}
+
+	return ids
+}
+
+func TestKeyEmbeddedReleaseSetResources(t *testing.T) {
+	resources, err := keyEmbeddedReleaseSetResources([]map[string]interface{}{
+		{KeyEmbeddedKey: "frontend"},
+		{KeyEmbeddedKey: "backend"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"frontend", "backend"}, embeddedIds(resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected ids: want %v, got %v", want, got)
+	}
+
+	if _, err := keyEmbeddedReleaseSetResources([]map[string]interface{}{
+		{KeyEmbeddedKey: "frontend"},
+		{},
+	}); err == nil {
+		t.Errorf("expected an error for the missing key")
+	}
+
+	if _, err := keyEmbeddedReleaseSetResources([]map[string]interface{}{
+		{KeyEmbeddedKey: "frontend"},
+		{KeyEmbeddedKey: "frontend"},
+	}); err == nil {
+		t.Errorf("expected an error for the duplicate key")
+	}
+}
+
+func TestKeyRecordedEmbeddedReleaseSetResources(t *testing.T) {
+	// Entries recorded before keys were required are identified by their positions
+	resources, err := keyRecordedEmbeddedReleaseSetResources([]map[string]interface{}{
+		{KeyEmbeddedKey: "frontend"},
+		{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := []string{"frontend", "1"}, embeddedIds(resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected ids: want %v, got %v", want, got)
+	}
+}
+
+func TestMatchEmbeddedReleaseSetResources(t *testing.T) {
+	testcases := []struct {
+		name        string
+		olds        []map[string]interface{}
+		news        []map[string]interface{}
+		wantRemoved []string
+		wantCreated []string
+	}{
+		{
+			name: "reordered",
+			olds: []map[string]interface{}{
+				{KeyEmbeddedKey: "a"},
+				{KeyEmbeddedKey: "b"},
+				{KeyEmbeddedKey: "c"},
+			},
+			news: []map[string]interface{}{
+				{KeyEmbeddedKey: "c"},
+				{KeyEmbeddedKey: "a"},
+				{KeyEmbeddedKey: "b"},
+			},
+		},
+		{
+			name: "the first entry removed",
+			olds: []map[string]interface{}{
+				{KeyEmbeddedKey: "a"},
+				{KeyEmbeddedKey: "b"},
+				{KeyEmbeddedKey: "c"},
+			},
+			news: []map[string]interface{}{
+				{KeyEmbeddedKey: "b"},
+				{KeyEmbeddedKey: "c"},
+			},
+			wantRemoved: []string{"a"},
+		},
+		{
+			name: "added in the middle",
+			olds: []map[string]interface{}{
+				{KeyEmbeddedKey: "a"},
+				{KeyEmbeddedKey: "c"},
+			},
+			news: []map[string]interface{}{
+				{KeyEmbeddedKey: "a"},
+				{KeyEmbeddedKey: "b"},
+				{KeyEmbeddedKey: "c"},
+			},
+			wantCreated: []string{"b"},
+		},
+		{
+			name: "keys added to entries recorded without keys",
+			olds: []map[string]interface{}{
+				{},
+				{},
+			},
+			news: []map[string]interface{}{
+				{KeyEmbeddedKey: "a"},
+				{KeyEmbeddedKey: "b"},
+			},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			news, err := keyEmbeddedReleaseSetResources(tc.news)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			olds, err := keyRecordedEmbeddedReleaseSetResources(adoptEmbeddedKeys(tc.olds, tc.news))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			existing, removed := matchEmbeddedReleaseSetResources(olds, news)
+
+			if got := embeddedIds(removed); !reflect.DeepEqual(got, tc.wantRemoved) {
+				t.Errorf("unexpected removed entries: want %v, got %v", tc.wantRemoved, got)
+			}
+
+			var created []string
+
+			for _, fs := range news {
+				if !existing[fs.Id()] {
+					created = append(created, fs.Id())
+				}
+			}
+
+			if !reflect.DeepEqual(created, tc.wantCreated) {
+				t.Errorf("unexpected created entries: want %v, got %v", tc.wantCreated, created)
+			}
+		})
+	}
+}
@@ -6,17 +6,23 @@ import (
 	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk/tfsdk"
 	"github.com/rs/xid"
 	"golang.org/x/xerrors"
+	"os"
 	"runtime/debug"
+	"strings"
 
 	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/helper/validation"
 )
 
 const KeyNamespace = "namespace"
 const KeyName = "name"
 const KeyChart = "chart"
 const KeyVersion = "version"
+const KeyHelmfileVersion = "helmfile_version"
 const KeyHelmVersion = "helm_version"
 const KeyHelmDiffVersion = "helm_diff_version"
+const KeyKubectlVersion = "kubectl_version"
+const KeyKustomizeVersion = "kustomize_version"
 const KeyVerify = "verify"
 const KeyWait = "wait"
 const KeyForce = "force"
@@ -25,6 +31,85 @@ const KeyCleanupOnFail = "cleanup_on_fail"
 const KeyTimeout = "timeout"
 const KeyKubecontext = "kubecontext"
 const KeyKubeconfig = "kubeconfig"
+const KeyRepository = "repository"
+const KeyURL = "url"
+const KeyOCI = "oci"
+const KeyUsername = "username"
+const KeyPassword = "password"
+const KeyCAFile = "ca_file"
+const KeyCertFile = "cert_file"
+const KeyKeyFile = "key_file"
+const KeyLabels = "labels"
+const KeyNeeds = "needs"
+const KeyCreateNamespace = "create_namespace"
+const KeyInstalled = "installed"
+const KeyHook = "hook"
+const KeyEvents = "events"
+const KeyShowLogs = "show_logs"
+const KeyCommand = "command"
+const KeyArgs = "args"
+const KeyPostRenderer = "post_renderer"
+const KeyDisableValidation = "disable_validation"
+const KeySecrets = "secrets"
+const KeySet = "set"
+const KeySetString = "set_string"
+const KeyValue = "value"
+const KeyFile = "file"
+const KeyMissingFileHandler = "missing_file_handler"
+const KeyHistoryMax = "history_max"
+const KeyJSONPatches = "json_patches"
+const KeyStrategicMergePatches = "strategic_merge_patches"
+const KeyTransformers = "transformers"
+const KeyDependency = "dependency"
+const KeyAlias = "alias"
+const KeyRevision = "revision"
+const KeyStatus = "status"
+const KeyAppVersion = "app_version"
+const KeyChartVersion = "chart_version"
+const KeyLastDeployed = "last_deployed"
+const KeyManifest = "manifest"
+const KeyHashManifest = "hash_manifest"
+
+// releaseStatusKeys is the list of computed attributes filled from the live release
+var releaseStatusKeys = []string{
+	KeyRevision,
+	KeyStatus,
+	KeyAppVersion,
+	KeyChartVersion,
+	KeyLastDeployed,
+	KeyManifest,
+}
+
+// chartifySchema is the schema for chartify transformations like json_patches, each item of which is
+// a JSON-encoded object or a JSON-encoded string that is the path to the file containing the object
+var chartifySchema = &schema.Schema{
+	Type:     schema.TypeList,
+	Optional: true,
+	ForceNew: false,
+	Elem: &schema.Schema{
+		Type:         schema.TypeString,
+		ValidateFunc: validation.ValidateJsonString,
+	},
+}
+
+// setValueSchema is the schema for `set` and `set_string` blocks, each of which corresponds to
+// an item in `set` and `setString` of a helmfile release
+var setValueSchema = &schema.Resource{
+	Schema: map[string]*schema.Schema{
+		KeyName: {
+			Type:     schema.TypeString,
+			Required: true,
+		},
+		KeyValue: {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+		KeyFile: {
+			Type:     schema.TypeString,
+			Optional: true,
+		},
+	},
+}
 
 func resourceHelmfileRelease() *schema.Resource {
 	return &schema.Resource{
@@ -33,6 +118,9 @@ func resourceHelmfileRelease() *schema.Resource {
 		Read:          resourceHelmfileReleaseRead,
 		Update:        resourceHelmfileReleaseUpdate,
 		CustomizeDiff: resourceHelmfileReleaseDiff,
+		Importer: &schema.ResourceImporter{
+			State: resourceHelmfileReleaseImport,
+		},
 		Schema: map[string]*schema.Schema{
 			KeyAWSRegion: {
 				Type:     schema.TypeString,
@@ -67,12 +155,93 @@ func resourceHelmfileRelease() *schema.Resource {
 				ForceNew: false,
 				Default:  "",
 			},
+			KeyHelmfileVersion: {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+				Default:  "",
+			},
 			KeyHelmVersion: {
 				Type:     schema.TypeString,
 				Optional: true,
 				ForceNew: false,
 				Default:  "",
 			},
+			KeyHelmDiffVersion: {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+				Default:  "",
+			},
+			KeyEnvironmentVariables: {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem:     schema.TypeString,
+			},
+			KeyKubectlVersion: {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+				Default:  "",
+			},
+			KeyKustomizeVersion: {
+				Type:     schema.TypeString,
+				Optional: true,
+				ForceNew: false,
+				Default:  "",
+			},
+			KeyHelmPlugins: {
+				Type:     schema.TypeMap,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			KeyRepository: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						KeyName: {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						KeyURL: {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						KeyOCI: {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						KeyUsername: {
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
+						KeyPassword: {
+							Type:      schema.TypeString,
+							Optional:  true,
+							Sensitive: true,
+						},
+						KeyCAFile: {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						KeyCertFile: {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						KeyKeyFile: {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
 			KeyValues: {
 				Type:     schema.TypeList,
 				Optional: true,
@@ -117,6 +286,129 @@ func resourceHelmfileRelease() *schema.Resource {
 				Optional: true,
 				Default:  0,
 			},
+			KeyLabels: {
+				Type:     schema.TypeMap,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			KeyNeeds: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			KeyCreateNamespace: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			KeyInstalled: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			KeyHook: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						KeyEvents: {
+							Type:     schema.TypeList,
+							Required: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+						KeyShowLogs: {
+							Type:     schema.TypeBool,
+							Optional: true,
+							Default:  false,
+						},
+						KeyCommand: {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						KeyArgs: {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+					},
+				},
+			},
+			KeyPostRenderer: {
+				Type:     schema.TypeString,
+				Optional: true,
+				Default:  "",
+			},
+			KeyDisableValidation: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			KeySecrets: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			KeySet: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem:     setValueSchema,
+			},
+			KeySetString: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem:     setValueSchema,
+			},
+			KeyMissingFileHandler: {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "",
+				ValidateFunc: validation.StringInSlice([]string{"", "Error", "Warn", "Info", "Debug"}, false),
+			},
+			KeyHistoryMax: {
+				Type:     schema.TypeInt,
+				Optional: true,
+				Default:  0,
+			},
+			KeyJSONPatches:           chartifySchema,
+			KeyStrategicMergePatches: chartifySchema,
+			KeyTransformers:          chartifySchema,
+			KeyDependency: {
+				Type:     schema.TypeList,
+				Optional: true,
+				ForceNew: false,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						KeyChart: {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						KeyVersion: {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						KeyAlias: {
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+					},
+				},
+			},
 			KeyKubeconfig: {
 				Type:     schema.TypeString,
 				Required: true,
@@ -144,25 +436,97 @@ func resourceHelmfileRelease() *schema.Resource {
 				Type:     schema.TypeString,
 				Computed: true,
 			},
+			KeyDiffSHA256: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyApprovedDiffSHA256: {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+			KeyVerifyPlanOnApply: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			KeyDestructiveChanges: {
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			KeyAllowDestructiveChanges: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
 			KeyApplyOutput: {
 				Type:     schema.TypeString,
 				Computed: true,
 			},
+			KeyLastOperation: lastOperationSchema,
 			KeyError: {
 				Type:     schema.TypeString,
 				Computed: true,
 			},
+			KeyResolvedHelmfileVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyResolvedHelmVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyResolvedHelmDiffVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
 			KeyDirty: {
 				Type:     schema.TypeBool,
 				Optional: true,
 				Default:  false,
 			},
+			KeyChartHash: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyHashManifest: {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			KeyRevision: {
+				Type:     schema.TypeInt,
+				Computed: true,
+			},
+			KeyStatus: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyAppVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyChartVersion: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyLastDeployed: {
+				Type:     schema.TypeString,
+				Computed: true,
+			},
+			KeyManifest: {
+				Type:      schema.TypeString,
+				Computed:  true,
+				Sensitive: true,
+			},
 		},
 	}
 }
 
 //helpers to unwravel the recursive bits by adding a base condition
-func resourceHelmfileReleaseCreate(d *schema.ResourceData, _ interface{}) (finalErr error) {
+func resourceHelmfileReleaseCreate(d *schema.ResourceData, meta interface{}) (finalErr error) {
 	defer func() {
 		if err := recover(); err != nil {
 			finalErr = fmt.Errorf("unhandled error: %v\n%s", err, debug.Stack())
@@ -174,20 +538,35 @@ func resourceHelmfileReleaseCreate(d *schema.ResourceData, _ interface{}) (final
 		return err
 	}
 
+	configureReleaseSet(meta, rs)
+	sp := rs.startOperation("helmfile_release", d.Id(), OperationCreate)
+	defer func() { sp.finish(finalErr) }()
+
 	if err := CreateReleaseSet(newContext(d), rs, d); err != nil {
 		return err
 	}
 
+	d.Set(KeyChartHash, rs.LocalChartHash)
+
+	// The release needs to be read before setting the ID, as the release name defaults to the ID that is empty at this point.
+	r := NewRelease(d)
+
 	d.MarkNewResource()
 
 	//create random uuid for the id
 	id := xid.New().String()
 	d.SetId(id)
 
+	// The release has already been applied at this point. Failing here would leave the release outside of the state,
+	// so the status is left empty until the next refresh instead.
+	if err := setReleaseStatus(rs, r, d); err != nil {
+		rs.logf("[WARN] Failed to read the release status: %v", err)
+	}
+
 	return nil
 }
 
-func resourceHelmfileReleaseRead(d *schema.ResourceData, _ interface{}) (finalErr error) {
+func resourceHelmfileReleaseRead(d *schema.ResourceData, meta interface{}) (finalErr error) {
 	defer func() {
 		if err := recover(); err != nil {
 			finalErr = fmt.Errorf("unhandled error: %v\n%s", err, debug.Stack())
@@ -199,10 +578,26 @@ func resourceHelmfileReleaseRead(d *schema.ResourceData, _ interface{}) (finalEr
 		return err
 	}
 
-	return ReadReleaseSet(newContext(d), rs, d)
+	configureReleaseSet(meta, rs)
+	sp := rs.startOperation("helmfile_release", d.Id(), OperationRead)
+	defer func() { sp.finish(finalErr) }()
+
+	if err := ReadReleaseSet(newContext(d), rs, d); err != nil {
+		return err
+	}
+
+	if rs.Kubeconfig == "" {
+		return nil
+	}
+
+	if err := setReleaseStatus(rs, NewRelease(d), d); err != nil {
+		rs.logf("[DEBUG] Failed to read the release status: %v", err)
+	}
+
+	return nil
 }
 
-func resourceHelmfileReleaseUpdate(d *schema.ResourceData, _ interface{}) (finalErr error) {
+func resourceHelmfileReleaseUpdate(d *schema.ResourceData, meta interface{}) (finalErr error) {
 	defer func() {
 		if err := recover(); err != nil {
 			finalErr = fmt.Errorf("unhandled error: %v\n%s", err, debug.Stack())
@@ -214,10 +609,26 @@ func resourceHelmfileReleaseUpdate(d *schema.ResourceData, _ interface{}) (final
 		return err
 	}
 
-	return UpdateReleaseSet(newContext(d), rs, d)
+	configureReleaseSet(meta, rs)
+	sp := rs.startOperation("helmfile_release", d.Id(), OperationUpdate)
+	defer func() { sp.finish(finalErr) }()
+
+	if err := UpdateReleaseSet(newContext(d), rs, d); err != nil {
+		return err
+	}
+
+	d.Set(KeyChartHash, rs.LocalChartHash)
+
+	// The release has already been applied at this point. Failing here would taint the applied release,
+	// so the status is left as-is until the next refresh instead.
+	if err := setReleaseStatus(rs, NewRelease(d), d); err != nil {
+		rs.logf("[WARN] Failed to read the release status: %v", err)
+	}
+
+	return nil
 }
 
-func resourceHelmfileReleaseDiff(d *schema.ResourceDiff, _ interface{}) (finalErr error) {
+func resourceHelmfileReleaseDiff(d *schema.ResourceDiff, meta interface{}) (finalErr error) {
 	defer func() {
 		if err := recover(); err != nil {
 			finalErr = fmt.Errorf("unhandled error: %v\n%s", err, debug.Stack())
@@ -229,21 +640,43 @@ func resourceHelmfileReleaseDiff(d *schema.ResourceDiff, _ interface{}) (finalEr
 		return err
 	}
 
+	configureReleaseSet(meta, rs)
+	sp := rs.startOperation("helmfile_release", d.Id(), OperationPlan)
+	defer func() { sp.finish(finalErr) }()
+
 	diff, err := DiffReleaseSet(newContext(d), rs, resourceDiffToFields(d))
 	if err != nil {
 		return err
 	}
 
+	// We intentionally don't update chart_hash on read, so that any edit to the local chart shows up in the plan
+	// even when helmfile-diff detected no changes.
+	if d.Get(KeyChartHash).(string) != rs.LocalChartHash {
+		if err := d.SetNew(KeyChartHash, rs.LocalChartHash); err != nil {
+			return xerrors.Errorf("setting new %s: %w", KeyChartHash, err)
+		}
+	}
+
 	if diff != "" {
 		if err := d.SetNewComputed(KeyApplyOutput); err != nil {
 			return xerrors.Errorf("setting new computed %s: %w", KeyApplyOutput, err)
 		}
+
+		if err := d.SetNewComputed(KeyLastOperation); err != nil {
+			return xerrors.Errorf("setting new computed %s: %w", KeyLastOperation, err)
+		}
+
+		for _, k := range releaseStatusKeys {
+			if err := d.SetNewComputed(k); err != nil {
+				return xerrors.Errorf("setting new computed %s: %w", k, err)
+			}
+		}
 	}
 
 	return nil
 }
 
-func resourceHelmfileReleaseDelete(d *schema.ResourceData, _ interface{}) (finalErr error) {
+func resourceHelmfileReleaseDelete(d *schema.ResourceData, meta interface{}) (finalErr error) {
 	defer func() {
 		if err := recover(); err != nil {
 			finalErr = fmt.Errorf("unhandled error: %v\n%s", err, debug.Stack())
@@ -255,6 +688,10 @@ func resourceHelmfileReleaseDelete(d *schema.ResourceData, _ interface{}) (final
 		return err
 	}
 
+	configureReleaseSet(meta, rs)
+	sp := rs.startOperation("helmfile_release", d.Id(), OperationDelete)
+	defer func() { sp.finish(finalErr) }()
+
 	if err := DeleteReleaseSet(newContext(d), rs, d); err != nil {
 		return err
 	}
@@ -264,6 +701,82 @@ func resourceHelmfileReleaseDelete(d *schema.ResourceData, _ interface{}) (final
 	return nil
 }
 
+func resourceHelmfileReleaseImport(d *schema.ResourceData, _ interface{}) ([]*schema.ResourceData, error) {
+	d, err := ImportRelease(d)
+	if err != nil {
+		return nil, fmt.Errorf("importing release: %w", err)
+	}
+
+	return []*schema.ResourceData{d}, nil
+}
+
+// ImportRelease reads the live helm release identified by the import ID of `<kubecontext>/<namespace>/<name>`
+// and fills in the resource with the release's chart, chart version, namespace and user-supplied values.
+//
+// The kubecontext part can be empty, like `/default/myapp`, to use the current context.
+// As helm doesn't record the repository the chart came from, the imported `chart` is the bare chart name.
+// Prefix it with the repository name, like `sp/podinfo`, in your configuration.
+//
+// The release is read from the cluster in the kubeconfig at the path in the KUBECONFIG environment variable,
+// which is recorded to `kubeconfig` of the resource.
+func ImportRelease(d *schema.ResourceData) (*schema.ResourceData, error) {
+	parts := strings.Split(d.Id(), "/")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("unexpected import ID %q: it must be in the form of <kubecontext>/<namespace>/<name>", d.Id())
+	}
+
+	kubecontext, namespace, name := parts[0], parts[1], parts[2]
+
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if kubeconfig == "" {
+		return nil, fmt.Errorf("KUBECONFIG must be set to the path of the kubeconfig for the release, that is the same as %s in your configuration", KeyKubeconfig)
+	} else if strings.Contains(kubeconfig, string(os.PathListSeparator)) {
+		return nil, fmt.Errorf("KUBECONFIG must be set to a single kubeconfig path, that is the same as %s in your configuration: got %q", KeyKubeconfig, kubeconfig)
+	}
+
+	helm := &helmClient{Kubecontext: kubecontext, Env: []string{"KUBECONFIG=" + kubeconfig}}
+
+	rel, err := helm.getRelease(namespace, name)
+	if err != nil {
+		return nil, err
+	} else if rel == nil {
+		return nil, fmt.Errorf("release %q not found in namespace %q", name, namespace)
+	}
+
+	values, err := helm.getValues(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	chart, chartVersion := splitChart(rel.Chart)
+
+	var releaseValues []interface{}
+
+	if len(values) > 0 {
+		bs, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+
+		releaseValues = append(releaseValues, string(bs))
+	}
+
+	d.SetId(newId())
+
+	d.Set(KeyName, name)
+	d.Set(KeyNamespace, namespace)
+	d.Set(KeyKubeconfig, kubeconfig)
+	d.Set(KeyKubecontext, kubecontext)
+	d.Set(KeyChart, chart)
+	d.Set(KeyVersion, chartVersion)
+	d.Set(KeyValues, releaseValues)
+	d.Set(KeyBin, DefaultHelmfileBinary)
+	d.Set(KeyHelmBin, DefaultHelmBinary)
+	d.Set(KeyDirty, false)
+
+	return d, nil
+}
+
 func NewReleaseSetWithSingleRelease(d ResourceRead) (*ReleaseSet, error) {
 	r := NewRelease(d)
 
@@ -275,29 +788,52 @@ func NewReleaseSetWithSingleRelease(d ResourceRead) (*ReleaseSet, error) {
 		}
 		values = append(values, vv)
 	}
+	var sensitiveEnv map[string]Sensitive
+
+	release := map[string]interface{}{
+		"namespace":     r.Namespace,
+		"name":          r.Name,
+		"chart":         r.Chart,
+		"version":       r.Version,
+		"values":        values,
+		"verify":        r.Verify,
+		"wait":          r.Wait,
+		"force":         r.Force,
+		"atomic":        r.Atomic,
+		"cleanupOnFail": r.CleanupOnFail,
+		"timeout":       r.Timeout,
+		"kubeContext":   r.Kubecontext,
+	}
+
+	renderOptionalReleaseFields(r, release)
+
+	if err := renderChartifyFields(r, release); err != nil {
+		return nil, err
+	}
+
 	content := map[string]interface{}{
 		"releases": []interface{}{
-			map[string]interface{}{
-				"namespace":     r.Namespace,
-				"name":          r.Name,
-				"chart":         r.Chart,
-				"version":       r.Version,
-				"values":        values,
-				"verify":        r.Verify,
-				"wait":          r.Wait,
-				"force":         r.Force,
-				"atomic":        r.Atomic,
-				"cleanupOnFail": r.CleanupOnFail,
-				"timeout":       r.Timeout,
-				"kubeContext":   r.Kubecontext,
-			},
+			release,
 		},
 	}
+	if len(r.Repositories) > 0 {
+		content["repositories"], sensitiveEnv = renderRepositories(r.Repositories)
+	}
+
 	bs, err := json.Marshal(content)
 	if err != nil {
 		return nil, err
 	}
 
+	var chartHash string
+
+	if dir, ok := localChartDir(r.WorkingDirectory, r.Chart); ok {
+		chartHash, err = hashChartDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("computing hash of local chart: %w", err)
+		}
+	}
+
 	rs := &ReleaseSet{
 		Bin:              r.Bin,
 		HelmBin:          r.HelmBin,
@@ -305,6 +841,18 @@ func NewReleaseSetWithSingleRelease(d ResourceRead) (*ReleaseSet, error) {
 		Environment:      "default",
 		WorkingDirectory: r.WorkingDirectory,
 		Kubeconfig:       r.Kubeconfig,
+		Kubecontext:      r.Kubecontext,
+		Version:          r.HelmfileVersion,
+		HelmVersion:      r.HelmVersion,
+		HelmDiffVersion:  r.HelmDiffVersion,
+		KubectlVersion:   r.KubectlVersion,
+		KustomizeVersion: r.KustomizeVersion,
+		HelmPlugins:      r.HelmPlugins,
+		LocalChartHash:   chartHash,
+
+		EnvironmentVariables: r.EnvironmentVariables,
+
+		SensitiveEnvironmentVariables: sensitiveEnv,
 	}
 
 	return rs, nil
@@ -30,6 +30,7 @@ const KeyDirty = "dirty"
 const KeyConcurrency = "concurrency"
 const KeyReleasesValues = "releases_values"
 const KeySkipDiffOnMissingFiles = "skip_diff_on_missing_files"
+const KeyHelmPlugins = "helm_plugins"
 
 const HelmfileDefaultPath = "helmfile.yaml"
 
@@ -139,6 +140,26 @@ var ReleaseSetSchema = map[string]*schema.Schema{
 		ForceNew: false,
 		Default:  "",
 	},
+	KeyKubectlVersion: {
+		Type:     schema.TypeString,
+		Optional: true,
+		ForceNew: false,
+		Default:  "",
+	},
+	KeyKustomizeVersion: {
+		Type:     schema.TypeString,
+		Optional: true,
+		ForceNew: false,
+		Default:  "",
+	},
+	KeyHelmPlugins: {
+		Type:     schema.TypeMap,
+		Optional: true,
+		ForceNew: false,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+	},
 	KeyEnvironment: {
 		Type:     schema.TypeString,
 		Optional: true,
@@ -149,6 +170,31 @@ var ReleaseSetSchema = map[string]*schema.Schema{
 		Type:     schema.TypeString,
 		Computed: true,
 	},
+	KeyDiffSHA256: {
+		Type:     schema.TypeString,
+		Computed: true,
+	},
+	KeyApprovedDiffSHA256: {
+		Type:     schema.TypeString,
+		Optional: true,
+	},
+	KeyVerifyPlanOnApply: {
+		Type:     schema.TypeBool,
+		Optional: true,
+		Default:  false,
+	},
+	KeyDestructiveChanges: {
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+	},
+	KeyAllowDestructiveChanges: {
+		Type:     schema.TypeBool,
+		Optional: true,
+		Default:  true,
+	},
 	KeyApplyOutput: {
 		Type:     schema.TypeString,
 		Computed: true,
@@ -157,6 +203,34 @@ var ReleaseSetSchema = map[string]*schema.Schema{
 		Type:     schema.TypeString,
 		Computed: true,
 	},
+	KeyResolvedHelmfileVersion: {
+		Type:     schema.TypeString,
+		Computed: true,
+	},
+	KeyResolvedHelmVersion: {
+		Type:     schema.TypeString,
+		Computed: true,
+	},
+	KeyResolvedHelmDiffVersion: {
+		Type:     schema.TypeString,
+		Computed: true,
+	},
+	KeyLastOperation: lastOperationSchema,
+	KeyPolicy:        policySchema,
+	KeyPolicyFiles: {
+		Type:     schema.TypeList,
+		Optional: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+	},
+	KeyPolicyWarnings: {
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+	},
 	KeyDirty: {
 		Type:     schema.TypeBool,
 		Optional: true,
@@ -201,7 +275,11 @@ func resourceReleaseSetCreate(d *schema.ResourceData, meta interface{}) (finalEr
 		return err
 	}
 
-	if err := CreateReleaseSet(newContext(d), fs, d); err != nil {
+	configureReleaseSet(meta, fs)
+	sp := fs.startOperation("helmfile_release_set", d.Id(), OperationCreate)
+	defer func() { sp.finish(finalErr) }()
+
+	if err := CreateReleaseSet(newContext(d), fs, d, WithDiffConfig(releaseSetDiffConfig(meta))); err != nil {
 		return fmt.Errorf("creating release set: %w", err)
 	}
 
@@ -231,6 +309,10 @@ func resourceReleaseSetRead(d *schema.ResourceData, meta interface{}) (finalErr
 		return err
 	}
 
+	configureReleaseSet(meta, fs)
+	sp := fs.startOperation("helmfile_release_set", d.Id(), OperationRead)
+	defer func() { sp.finish(finalErr) }()
+
 	if err := ReadReleaseSet(newContext(d), fs, d); err != nil {
 		return fmt.Errorf("reading release set: %w", err)
 	}
@@ -253,13 +335,17 @@ func resourceReleaseSetDiff(d *schema.ResourceDiff, meta interface{}) (finalErr
 		return err
 	}
 
+	configureReleaseSet(meta, fs)
+	sp := fs.startOperation("helmfile_release_set", d.Id(), OperationPlan)
+	defer func() { sp.finish(finalErr) }()
+
 	kubeconfig, err := getKubeconfig(fs)
 	if err != nil {
 		return fmt.Errorf("getting kubeconfig: %w", err)
 	}
 
 	if fs.Kubeconfig == "" {
-		logf("Skipping helmfile-diff due to that kubeconfig is empty, which means that this operation has been called on a helmfile resource that depends on in-existent resource")
+		fs.logf("Skipping helmfile-diff due to that kubeconfig is empty, which means that this operation has been called on a helmfile resource that depends on in-existent resource")
 
 		return nil
 	}
@@ -267,16 +353,12 @@ func resourceReleaseSetDiff(d *schema.ResourceDiff, meta interface{}) (finalErr
 	if v, err := shouldDiff(fs); err != nil {
 		return xerrors.Errorf("checking skip_diff_on_missing_files to determine if the provider needs to run helmfile-diff: %w", err)
 	} else if !v {
-		logf("Skipping helmfile-diff due to that one or more files listed in skip_diff_on_missing_files were missing")
+		fs.logf("Skipping helmfile-diff due to that one or more files listed in skip_diff_on_missing_files were missing")
 
 		return nil
 	}
 
-	provider := meta.(*ProviderInstance)
-
-	diff, err := DiffReleaseSet(newContext(d), fs, resourceDiffToFields(d), WithDiffConfig(DiffConfig{
-		MaxDiffOutputLen: provider.MaxDiffOutputLen,
-	}))
+	diff, err := DiffReleaseSet(newContext(d), fs, resourceDiffToFields(d), WithDiffConfig(releaseSetDiffConfig(meta)))
 	if err != nil {
 		// helmfile_release_set.kubeconfig or helmfile_releaset_set.environment_variables.KUBECONFIG can be empty
 		// on `plan` if the value depends on another terraform resource.
@@ -296,12 +378,22 @@ func resourceReleaseSetDiff(d *schema.ResourceDiff, meta interface{}) (finalErr
 		} else if !strings.Contains(err.Error(), "Kubernetes cluster unreachable") {
 			return fmt.Errorf("diffing release set: %w", err)
 		}
-		log.Printf("Ignoring helmfile-diff error on plan because it may be due to that terraform's behaviour that "+
+		fs.logf("Ignoring helmfile-diff error on plan because it may be due to that terraform's behaviour that "+
 			"helmfile_releaset_set.kubeconfig that depends on another missing resource can be empty: %v", err)
 	}
 
 	if diff != "" {
-		d.SetNewComputed(KeyApplyOutput)
+		if err := d.SetNewComputed(KeyApplyOutput); err != nil {
+			return xerrors.Errorf("setting new computed %s: %w", KeyApplyOutput, err)
+		}
+
+		if err := d.SetNewComputed(KeyLastOperation); err != nil {
+			return xerrors.Errorf("setting new computed %s: %w", KeyLastOperation, err)
+		}
+	}
+
+	if err := planPolicyWarnings(newContext(d), fs, d, diff != ""); err != nil {
+		return err
 	}
 
 	return nil
@@ -319,7 +411,22 @@ func resourceReleaseSetUpdate(d *schema.ResourceData, meta interface{}) (finalEr
 		return err
 	}
 
-	return UpdateReleaseSet(newContext(d), fs, d)
+	configureReleaseSet(meta, fs)
+	sp := fs.startOperation("helmfile_release_set", d.Id(), OperationUpdate)
+	defer func() { sp.finish(finalErr) }()
+
+	return UpdateReleaseSet(newContext(d), fs, d, WithDiffConfig(releaseSetDiffConfig(meta)))
+}
+
+// releaseSetDiffConfig returns the configuration for diffing helmfile_release_set, that is used on plan and verified on apply
+func releaseSetDiffConfig(meta interface{}) DiffConfig {
+	var conf DiffConfig
+
+	if p, ok := meta.(*ProviderInstance); ok && p != nil {
+		conf.MaxDiffOutputLen = p.MaxDiffOutputLen
+	}
+
+	return conf
 }
 
 func resourceReleaseSetDelete(d *schema.ResourceData, meta interface{}) (finalErr error) {
@@ -334,6 +441,10 @@ func resourceReleaseSetDelete(d *schema.ResourceData, meta interface{}) (finalEr
 		return err
 	}
 
+	configureReleaseSet(meta, fs)
+	sp := fs.startOperation("helmfile_release_set", d.Id(), OperationDelete)
+	defer func() { sp.finish(finalErr) }()
+
 	if err := DeleteReleaseSet(newContext(d), fs, d); err != nil {
 		return err
 	}
@@ -0,0 +1,15 @@
+package helmfile
+
+// Sensitive is a string that must never appear in logs, like a password for a chart repository.
+// fmt prints it as a placeholder even when it's nested in a struct or a map printed with %v or %+v.
+type Sensitive string
+
+const sensitivePlaceholder = "(sensitive value)"
+
+func (s Sensitive) String() string {
+	return sensitivePlaceholder
+}
+
+func (s Sensitive) GoString() string {
+	return sensitivePlaceholder
+}
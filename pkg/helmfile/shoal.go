@@ -14,7 +14,21 @@ import (
 
 var shoalMu sync.Mutex
 
-func prepareBinaries(fs *ReleaseSet) (*string, *string, error) {
+// DefaultShoalSyncTimeout is the maximum duration to wait for shoal-sync when ReleaseSet.ShoalSyncTimeout is not set
+const DefaultShoalSyncTimeout = 60 * time.Second
+
+// binaries is the set of executables and the environment variables needed to run helmfile and helm
+// installed by shoal
+type binaries struct {
+	Helmfile string
+	Helm     string
+
+	// Env is the list of environment variables in the form of NAME=VALUE that is passed to helmfile and helm.
+	// It's used to let helm find plugins installed by shoal without modifying the provider's own process environment.
+	Env []string
+}
+
+func prepareBinaries(fs *ReleaseSet) (*binaries, error) {
 	conf := shoal.Config{
 		Git: shoal.Git{
 			Provider: "go-git",
@@ -27,7 +41,9 @@ func prepareBinaries(fs *ReleaseSet) (*string, *string, error) {
 
 	helmVersion := fs.HelmVersion
 
-	installHelm := helmVersion != ""
+	// A locally configured helm binary is never overridden by the one installed by shoal.
+	// Instead, we make sure that it satisfies the version constraint.
+	installHelm := helmVersion != "" && !isLocalBinary(helmBin, DefaultHelmBinary)
 
 	if installHelm {
 		conf.Dependencies = append(conf.Dependencies,
@@ -37,18 +53,20 @@ func prepareBinaries(fs *ReleaseSet) (*string, *string, error) {
 				Version: helmVersion,
 			},
 		)
-		helmDiffVersion := fs.HelmDiffVersion
-		if helmDiffVersion == "" {
-			helmDiffVersion = "master"
-		}
-		conf.Helm.Plugins.Diff = helmDiffVersion
+	}
+
+	plugins, err := getHelmPlugins(fs)
+	if err != nil {
+		return nil, err
 	}
 
 	helmfileBin := fs.Bin
 
 	helmfileVersion := fs.Version
 
-	installHelmfile := helmfileVersion != ""
+	installHelmfile := helmfileVersion != "" && !isLocalBinary(helmfileBin, DefaultHelmfileBinary)
+
+	var installTools bool
 
 	if installHelmfile {
 		conf.Dependencies = append(conf.Dependencies,
@@ -60,6 +78,29 @@ func prepareBinaries(fs *ReleaseSet) (*string, *string, error) {
 		)
 	}
 
+	// kubectl and kustomize aren't run by the provider directly, but by helmfile and chartify.
+	// We add them to PATH of helmfile so that they don't need to be preinstalled on the host.
+	for _, food := range []struct {
+		name, version string
+	}{
+		{"kubectl", fs.KubectlVersion},
+		{"kustomize", fs.KustomizeVersion},
+	} {
+		if food.version == "" {
+			continue
+		}
+
+		conf.Dependencies = append(conf.Dependencies,
+			shoal.Dependency{
+				Rig:     rig,
+				Food:    food.name,
+				Version: food.version,
+			},
+		)
+
+		installTools = true
+	}
+
 	shoalMu.Lock()
 	defer shoalMu.Unlock()
 
@@ -67,65 +108,170 @@ func prepareBinaries(fs *ReleaseSet) (*string, *string, error) {
 
 	s, err := shoal.New(shoal.LogOutput(buf))
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	if len(conf.Dependencies) > 0 {
-		if err := s.Init(); err != nil {
-			return nil, nil, fmt.Errorf("initializing shoal: %w\n%s", err, buf.String())
-		}
+	rootDir, err := shoalRootDir(fs)
+	if err != nil {
+		return nil, xerrors.Errorf("determining shoal root directory: %w", err)
+	}
+
+	s.RootDir = rootDir
+
+	var env []string
+
+	if len(conf.Dependencies) > 0 || len(plugins) > 0 {
+		if len(conf.Dependencies) > 0 {
+			if err := s.Init(); err != nil {
+				return nil, fmt.Errorf("initializing shoal: %w\n%s", err, buf.String())
+			}
 
-		if err := s.InitGitProvider(conf); err != nil {
-			return nil, nil, fmt.Errorf("initializing shoal git provider: %w\n%s", err, buf.String())
+			if err := s.InitGitProvider(conf); err != nil {
+				return nil, fmt.Errorf("initializing shoal git provider: %w\n%s", err, buf.String())
+			}
 		}
 
-		wd, err := os.Getwd()
-		if err != nil {
-			return nil, nil, err
+		pluginHelmBin := helmBin
+		if pluginHelmBin == "" {
+			pluginHelmBin = DefaultHelmBinary
 		}
+		if installHelm {
+			pluginHelmBin = filepath.Join(s.BinPath(), "helm")
+		}
+
+		// Plugins for helm installed by shoal are installed under $ROOT_DIR/Library, the same location shoal has been installing helm-diff into.
+		// The environment variables are passed only to helmfile and helm so that the provider's own environment is kept intact.
+		// getHelmPlugins returns no plugins for helm on the host, which keeps using the plugins installed on the host.
+		pluginsDataHome := filepath.Join(s.RootDir, "Library")
 
-		if conf.Helm.Plugins.Diff != "" {
-			// TODO Any better place to do this?
-			// This is for letting helm know about the location of helm plugins installed by shoal
-			os.Setenv("XDG_DATA_HOME", filepath.Join(wd, ".shoal/Library"))
+		if len(plugins) > 0 {
+			env = append(env, helmPluginsEnv(pluginsDataHome)...)
 		}
 
-		errch := make(chan error)
+		sp := fs.startSpan("shoal sync",
+			logField{Key: "foods", Value: len(conf.Dependencies)},
+			logField{Key: "helm_plugins", Value: len(plugins)},
+		)
+
+		// Buffered so that the goroutine never leaks even when we stopped waiting for it due to the timeout
+		errch := make(chan error, 1)
 
 		go func() {
-			if err := s.Sync(conf); err != nil {
-				errch <- fmt.Errorf("syncing shoal foods: %w\n%s", err, buf.String())
+			if len(conf.Dependencies) > 0 {
+				if err := s.Sync(conf); err != nil {
+					errch <- fmt.Errorf("syncing shoal foods: %w", err)
+					return
+				}
+			}
+
+			if len(plugins) > 0 {
+				if err := installHelmPlugins(pluginHelmBin, pluginsDataHome, plugins); err != nil {
+					errch <- fmt.Errorf("installing helm plugins: %w", err)
+					return
+				}
 			}
 
 			errch <- nil
 		}()
 
-		timer := time.NewTicker(60 * time.Second)
+		timeout := fs.ShoalSyncTimeout
+		if timeout <= 0 {
+			timeout = DefaultShoalSyncTimeout
+		}
+
+		timer := time.NewTimer(timeout)
 		defer timer.Stop()
 
+		var syncErr error
+
 		select {
 		case err := <-errch:
 			if err != nil {
-				return nil, nil, xerrors.Errorf("running shoal-sync: %w\n%s", err, buf.String())
+				syncErr = xerrors.Errorf("running shoal-sync: %w\n%s", err, buf.String())
 			}
 		case <-timer.C:
-			return nil, nil, fmt.Errorf("timeout exceeded while waiting for shoal-sync\n%s", buf.String())
+			syncErr = fmt.Errorf("timeout exceeded while waiting for shoal-sync for %s\n%s", timeout, buf.String())
+		case <-fs.context().Done():
+			syncErr = fmt.Errorf("waiting for shoal-sync: %w", fs.context().Err())
+		}
+
+		sp.finish(syncErr)
+
+		if syncErr != nil {
+			return nil, syncErr
 		}
 	}
 
 	binPath := s.BinPath()
 
-	if helmfileVersion != "" {
+	if installTools {
+		env = append(env, "PATH="+binPath+string(os.PathListSeparator)+os.Getenv("PATH"))
+	}
+
+	if installHelmfile {
 		helmfileBin = filepath.Join(binPath, "helmfile")
+	} else if helmfileVersion != "" {
+		v, err := detectHelmfileVersion(helmfileBin)
+		if err != nil {
+			return nil, fmt.Errorf("detecting version of helmfile binary %s: %w", helmfileBin, err)
+		}
+
+		if err := checkVersionConstraint("helmfile", helmfileBin, v, helmfileVersion); err != nil {
+			return nil, err
+		}
 	}
 
-	if helmVersion != "" {
+	if installHelm {
 		helmBin = filepath.Join(binPath, "helm")
+	} else if helmVersion != "" {
+		v, err := detectHelmVersion(helmBin)
+		if err != nil {
+			return nil, fmt.Errorf("detecting version of helm binary %s: %w", helmBin, err)
+		}
+
+		if err := checkVersionConstraint("helm", helmBin, v, helmVersion); err != nil {
+			return nil, err
+		}
 	}
 
 	if helmfileBin == "" {
-		return nil, nil, errors.New("bug: helmfile_release_set.bin is missing")
+		return nil, errors.New("bug: helmfile_release_set.bin is missing")
+	}
+
+	return &binaries{
+		Helmfile: helmfileBin,
+		Helm:     helmBin,
+		Env:      env,
+	}, nil
+}
+
+// shoalRootDir returns the directory that shoal installs binaries into for the release set
+func shoalRootDir(fs *ReleaseSet) (string, error) {
+	if fs.BinaryCacheDir != "" {
+		return filepath.Abs(fs.BinaryCacheDir)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(wd, shoal.DefaultRootDir), nil
+}
+
+// binariesKey returns a string that changes whenever the versions of binaries or helm plugins used for the release set change.
+// It's used as a part of the key of the helmfile-diff cache, so that upgrading e.g. helm-diff invalidates the cache.
+func binariesKey(fs *ReleaseSet) (string, error) {
+	plugins, err := getHelmPlugins(fs)
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("helmfile=%s,helm=%s,kubectl=%s,kustomize=%s", fs.Version, fs.HelmVersion, fs.KubectlVersion, fs.KustomizeVersion)
+
+	for _, p := range plugins {
+		key += fmt.Sprintf(",plugin:%s=%s@%s", p.Name, p.Source, p.Version)
 	}
 
-	return &helmfileBin, &helmBin, nil
+	return key, nil
 }
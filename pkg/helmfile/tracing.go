@@ -0,0 +1,329 @@
+package helmfile
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	KeyOTLPEndpoint = "otlp_endpoint"
+	KeyTraceFile    = "trace_file"
+)
+
+const (
+	// EnvOTLPEndpoint is the standard OpenTelemetry environment variable for the base URL of the OTLP/HTTP collector
+	EnvOTLPEndpoint = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	// EnvTraceFile is the path to the file that traces are written to when no OTLP endpoint is set
+	EnvTraceFile = "TF_HELMFILE_TRACE_FILE"
+)
+
+const tracerName = "terraform-provider-helmfile"
+
+// Spans are exported in batches by the batch span processor of the OpenTelemetry SDK,
+// so that a slow or unreachable collector never slows down operations
+const (
+	traceBatchTimeout   = time.Second
+	traceExportTimeout  = 2 * time.Second
+	traceRetryInterval  = 200 * time.Millisecond
+	traceRetryMaxElapse = 5 * time.Second
+)
+
+var traceConfig = struct {
+	sync.RWMutex
+
+	endpoint string
+	file     string
+	provider *sdktrace.TracerProvider
+}{}
+
+// configureTracing enables tracing when either the OTLP endpoint or the trace file is set.
+// Spans are exported to the endpoint when it's set, and written to the file otherwise.
+func configureTracing(endpoint, file string) error {
+	endpoint = strings.TrimSuffix(endpoint, "/")
+
+	traceConfig.Lock()
+	defer traceConfig.Unlock()
+
+	if traceConfig.endpoint == endpoint && traceConfig.file == file {
+		return nil
+	}
+
+	if p := traceConfig.provider; p != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+		defer cancel()
+
+		// Spans of the previous configuration are sent before switching to the new one
+		if err := p.Shutdown(ctx); err != nil {
+			rootLogger.log(LogLevelWarn, "Failed flushing traces", logField{Key: "error", Value: err.Error()})
+		}
+	}
+
+	traceConfig.endpoint, traceConfig.file, traceConfig.provider = endpoint, file, nil
+
+	var client otlptrace.Client
+
+	if endpoint != "" {
+		c, err := newOTLPHTTPClient(endpoint)
+		if err != nil {
+			return err
+		}
+
+		client = c
+	} else if file != "" {
+		client = &traceFileClient{path: file}
+	} else {
+		return nil
+	}
+
+	exporter := otlptrace.NewUnstarted(client)
+
+	if err := exporter.Start(context.Background()); err != nil {
+		return fmt.Errorf("starting trace exporter: %w", err)
+	}
+
+	traceConfig.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(traceBatchTimeout)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", tracerName),
+			attribute.Int("process.pid", os.Getpid()),
+		)),
+	)
+
+	return nil
+}
+
+// newOTLPHTTPClient returns the client that sends spans to `/v1/traces` of the OTLP/HTTP collector at the base URL
+func newOTLPHTTPClient(endpoint string) (otlptrace.Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s %q: %w", KeyOTLPEndpoint, endpoint, err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("parsing %s %q: it must be a URL like http://localhost:4318", KeyOTLPEndpoint, endpoint)
+	}
+
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(u.Path + "/v1/traces"),
+		otlptracehttp.WithTimeout(traceExportTimeout),
+		otlptracehttp.WithRetry(otlptracehttp.RetryConfig{
+			Enabled:         true,
+			InitialInterval: traceRetryInterval,
+			MaxInterval:     traceExportTimeout,
+			MaxElapsedTime:  traceRetryMaxElapse,
+		}),
+	}
+
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	return otlptracehttp.NewClient(opts...), nil
+}
+
+// FlushTraces exports pending spans, waiting up to the timeout.
+// It's called before the provider exits so that traces of the last operations aren't lost.
+func FlushTraces(timeout time.Duration) {
+	p := tracerProvider()
+	if p == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := p.ForceFlush(ctx); err != nil {
+		rootLogger.log(LogLevelWarn, "Failed flushing traces", logField{Key: "error", Value: err.Error()})
+	}
+}
+
+func tracerProvider() *sdktrace.TracerProvider {
+	traceConfig.RLock()
+	defer traceConfig.RUnlock()
+
+	return traceConfig.provider
+}
+
+// span is a timed step of an operation, like running a helmfile command or syncing binaries with shoal.
+// All the methods are no-op on a nil span, which is returned when tracing is disabled.
+type span struct {
+	s trace.Span
+}
+
+// startSpan starts the span as a child of the span in ctx, or as the root span of a new trace when ctx has none.
+// The returned context carries the new span.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...logField) (context.Context, *span) {
+	p := tracerProvider()
+	if p == nil {
+		return ctx, nil
+	}
+
+	ctx, s := p.Tracer(tracerName).Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(spanAttributes(attrs)...))
+
+	return ctx, &span{s: s}
+}
+
+// startOperationSpan starts the root span for the operation on the resource, attributed with the fields of the logger
+// so that the trace can be correlated with log lines.
+func startOperationSpan(ctx context.Context, l *operationLogger) (context.Context, *span) {
+	name := l.field("resource") + "." + l.field("operation")
+
+	return startSpan(ctx, name, trace.SpanKindInternal, l.fields...)
+}
+
+// startOperation sets the logger and the root span for the operation on the resource to the release set
+func (fs *ReleaseSet) startOperation(resourceType, id, operation string) *span {
+	l := newOperationLogger(resourceType, id, operation)
+
+	fs.Logger = l
+
+	var sp *span
+
+	fs.Context, sp = startOperationSpan(fs.context(), l)
+
+	return sp
+}
+
+// startSpan starts the child span of the current operation on the release set.
+// Spans for embedded release sets are attributed with their keys.
+func (fs *ReleaseSet) startSpan(name string, attrs ...logField) *span {
+	return fs.startSpanOfKind(name, trace.SpanKindInternal, attrs...)
+}
+
+func (fs *ReleaseSet) startSpanOfKind(name string, kind trace.SpanKind, attrs ...logField) *span {
+	if l, ok := fs.Logger.(*operationLogger); ok {
+		if k := l.field("key"); k != "" {
+			attrs = append(attrs, logField{Key: "key", Value: k})
+		}
+	}
+
+	_, s := startSpan(fs.context(), name, kind, attrs...)
+
+	return s
+}
+
+// startCommandSpan starts the span for the child process run for the release set
+func (fs *ReleaseSet) startCommandSpan(args []string) *span {
+	name := filepath.Base(args[0])
+
+	if c := commandName(args); c != "" {
+		name += " " + c
+	}
+
+	return fs.startSpanOfKind(name, trace.SpanKindClient, logField{Key: "command", Value: strings.Join(redactArgs(args), " ")})
+}
+
+// subcommands are helmfile and helm subcommands that spans are named after
+var subcommands = []string{"apply", "build", "deps", "destroy", "diff", "get", "list", "plugin", "repos", "status", "sync", "template", "version"}
+
+// commandName returns the subcommand like `diff` in `helmfile --file f diff`, or an empty string if it's unknown
+func commandName(args []string) string {
+	for _, a := range args[1:] {
+		for _, c := range subcommands {
+			if a == c {
+				return a
+			}
+		}
+	}
+
+	return ""
+}
+
+// finish ends the span with the error status if err is not nil
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	if err != nil {
+		s.s.SetStatus(codes.Error, err.Error())
+	} else {
+		s.s.SetStatus(codes.Ok, "")
+	}
+
+	s.s.End()
+}
+
+func spanAttributes(fields []logField) []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+
+	for _, f := range fields {
+		switch t := f.Value.(type) {
+		case bool:
+			attrs = append(attrs, attribute.Bool(f.Key, t))
+		case int:
+			attrs = append(attrs, attribute.Int(f.Key, t))
+		case int64:
+			attrs = append(attrs, attribute.Int64(f.Key, t))
+		case float64:
+			attrs = append(attrs, attribute.Float64(f.Key, t))
+		default:
+			attrs = append(attrs, attribute.String(f.Key, fmt.Sprintf("%v", t)))
+		}
+	}
+
+	return attrs
+}
+
+// traceFileClient is the OTLP client that appends each batch of spans to the file as a JSON line.
+// Each line is the ExportTraceServiceRequest in the JSON mapping of protobuf.
+type traceFileClient struct {
+	path string
+}
+
+var _ otlptrace.Client = &traceFileClient{}
+
+func (c *traceFileClient) Start(ctx context.Context) error {
+	return nil
+}
+
+func (c *traceFileClient) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (c *traceFileClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	j, err := protojson.Marshal(&coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return fmt.Errorf("encoding spans: %w", err)
+	}
+
+	return writeSpans(c.path, j)
+}
+
+var traceFileMu sync.Mutex
+
+// writeSpans appends the export request to the file as a JSON line
+func writeSpans(path string, line []byte) error {
+	traceFileMu.Lock()
+	defer traceFileMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("opening trace file %s: %w", path, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("writing trace file %s: %w", path, err)
+	}
+
+	return nil
+}
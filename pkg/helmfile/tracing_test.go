@@ -0,0 +1,217 @@
+package helmfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func runTestOperation() {
+	fs := &ReleaseSet{}
+
+	root := fs.startOperation("helmfile_release_set", "abc", OperationPlan)
+
+	fs.startCommandSpan([]string{"/usr/local/bin/helmfile", "--file", "helmfile.yaml", "diff", "--set", "k=secret"}).finish(nil)
+	fs.startSpan("shoal sync").finish(errors.New("timeout"))
+
+	root.finish(nil)
+}
+
+// spansByName returns the spans in the export requests keyed by their names
+func spansByName(reqs []*coltracepb.ExportTraceServiceRequest) map[string]*tracepb.Span {
+	spans := map[string]*tracepb.Span{}
+
+	for _, req := range reqs {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					spans[s.Name] = s
+				}
+			}
+		}
+	}
+
+	return spans
+}
+
+func TestTracingToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+
+	if err := configureTracing("", path); err != nil {
+		t.Fatal(err)
+	}
+	defer configureTracing("", "")
+
+	runTestOperation()
+
+	FlushTraces(10 * time.Second)
+
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reqs []*coltracepb.ExportTraceServiceRequest
+
+	for _, line := range bytes.Split(bytes.TrimSpace(bs), []byte("\n")) {
+		var req coltracepb.ExportTraceServiceRequest
+
+		if err := protojson.Unmarshal(line, &req); err != nil {
+			t.Fatalf("unexpected trace file content %q: %v", string(line), err)
+		}
+
+		reqs = append(reqs, &req)
+	}
+
+	spans := spansByName(reqs)
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	root, cmd, shoal := spans["helmfile_release_set.plan"], spans["helmfile diff"], spans["shoal sync"]
+
+	if root == nil || len(root.ParentSpanId) != 0 {
+		t.Fatalf("unexpected root span: %v", root)
+	}
+
+	if cmd == nil || !bytes.Equal(cmd.ParentSpanId, root.SpanId) || !bytes.Equal(cmd.TraceId, root.TraceId) {
+		t.Fatalf("unexpected command span: %v", cmd)
+	}
+
+	if cmd.Kind != tracepb.Span_SPAN_KIND_CLIENT {
+		t.Errorf("unexpected kind of the command span: %v", cmd.Kind)
+	}
+
+	for _, a := range cmd.Attributes {
+		if a.Key == "command" && strings.Contains(a.Value.GetStringValue(), "secret") {
+			t.Errorf("expected --set values to be redacted: %s", a.Value.GetStringValue())
+		}
+	}
+
+	if shoal == nil || shoal.Status.Code != tracepb.Status_STATUS_CODE_ERROR || shoal.Status.Message != "timeout" {
+		t.Errorf("unexpected status of the failed span: %v", shoal)
+	}
+}
+
+// newTestCollector returns the OTLP/HTTP collector that fails the first `failures` requests with 503
+func newTestCollector(t *testing.T, failures int) (*httptest.Server, func() (int, []string, []*coltracepb.ExportTraceServiceRequest)) {
+	var (
+		mu       sync.Mutex
+		attempts int
+		paths    []string
+		reqs     []*coltracepb.ExportTraceServiceRequest
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		attempts++
+
+		if attempts <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+
+		var req coltracepb.ExportTraceServiceRequest
+
+		if err := proto.Unmarshal(body, &req); err != nil {
+			t.Errorf("unexpected request body: %v", err)
+		}
+
+		paths = append(paths, r.URL.Path)
+		reqs = append(reqs, &req)
+	}))
+
+	return srv, func() (int, []string, []*coltracepb.ExportTraceServiceRequest) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return attempts, paths, reqs
+	}
+}
+
+func TestTracingToEndpoint(t *testing.T) {
+	srv, received := newTestCollector(t, 0)
+	defer srv.Close()
+
+	if err := configureTracing(srv.URL+"/", filepath.Join(t.TempDir(), "unused.jsonl")); err != nil {
+		t.Fatal(err)
+	}
+	defer configureTracing("", "")
+
+	runTestOperation()
+
+	FlushTraces(10 * time.Second)
+
+	_, paths, reqs := received()
+
+	for _, p := range paths {
+		if p != "/v1/traces" {
+			t.Errorf("unexpected path: %s", p)
+		}
+	}
+
+	if n := len(spansByName(reqs)); n != 3 {
+		t.Errorf("expected 3 spans, got %d", n)
+	}
+}
+
+func TestTracingDisabled(t *testing.T) {
+	ctx, s := startSpan(context.Background(), "noop", trace.SpanKindInternal)
+	if s != nil || trace.SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("expected no span when tracing is disabled")
+	}
+
+	// Methods are no-op on the nil span
+	s.finish(errors.New("error"))
+}
+
+func TestTracingRetriesExport(t *testing.T) {
+	srv, received := newTestCollector(t, 1)
+	defer srv.Close()
+
+	if err := configureTracing(srv.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer configureTracing("", "")
+
+	runTestOperation()
+
+	FlushTraces(10 * time.Second)
+
+	attempts, _, reqs := received()
+
+	if attempts < 2 {
+		t.Errorf("expected the export to be retried, got %d attempts", attempts)
+	}
+
+	if n := len(spansByName(reqs)); n != 3 {
+		t.Errorf("expected 3 spans after the retry, got %d", n)
+	}
+}
+
+func TestConfigureTracing_InvalidEndpoint(t *testing.T) {
+	defer configureTracing("", "")
+
+	if err := configureTracing("localhost:4318", ""); err == nil {
+		t.Errorf("expected an error for the endpoint without the scheme")
+	}
+}
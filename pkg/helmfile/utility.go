@@ -1,9 +1,12 @@
 package helmfile
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
-	"log"
 	"os/exec"
+	"time"
 )
 
 // State is a wrapper around both the input and output attributes that are relavent for updates
@@ -29,8 +32,12 @@ func readEnvironmentVariables(ev map[string]interface{}, exclude string) []strin
 	return variables
 }
 
-func runCommand(ctx *sdk.Context, cmd *exec.Cmd, state *State, diffMode bool) (*State, error) {
+func runCommand(ctx *sdk.Context, fs *ReleaseSet, cmd *exec.Cmd, state *State, diffMode bool) (*State, error) {
+	sp := fs.startCommandSpan(cmd.Args)
+	start := time.Now()
 	res, err := ctx.Run(cmd)
+	fs.logCommand(cmd.Args, time.Since(start), err)
+	sp.finish(err)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +49,65 @@ func runCommand(ctx *sdk.Context, cmd *exec.Cmd, state *State, diffMode bool) (*
 		newState.Output = res.Output
 	}
 
-	log.Printf("[DEBUG] helmfile command new state: \"%v\"", newState)
+	fs.logf("[DEBUG] helmfile command new state: \"%v\"", newState)
 
 	return newState, nil
 }
+
+// runCommandWithFullOutput is the same as runCommand, except that it returns the whole output of the command.
+//
+// sdk.Context.Run keeps only the last 8KB of the output, which is fine for logs,
+// but silently drops the beginning of rendered manifests and diffs that are parsed or returned to the user.
+func runCommandWithFullOutput(ctx *sdk.Context, fs *ReleaseSet, cmd *exec.Cmd, diffMode bool) (*State, error) {
+	appendCredentialsEnv(ctx, cmd)
+
+	// stdout and stderr share the buffer so that they are interleaved in the same order as sdk.Context.Run does
+	var out bytes.Buffer
+
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	sp := fs.startCommandSpan(cmd.Args)
+	start := time.Now()
+	err := cmd.Run()
+
+	// helmfile exits with 2 when `diff --detailed-exitcode` detected changes, which sdk.Context.Run treats as a success, too
+	var exitErr *exec.ExitError
+
+	var exitStatus int
+
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+		exitStatus = 2
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("%s: %w\n%s", cmd.Path, err, out.String())
+	}
+
+	fs.logCommand(cmd.Args, time.Since(start), err)
+	sp.finish(err)
+	if err != nil {
+		return nil, err
+	}
+
+	newState := NewState()
+	if diffMode && exitStatus == 0 {
+		newState.Output = ""
+	} else {
+		newState.Output = out.String()
+	}
+
+	fs.logf("[DEBUG] helmfile command new state: \"%v\"", newState)
+
+	return newState, nil
+}
+
+// appendCredentialsEnv passes AWS credentials to the command the same way sdk.Context.Run does
+func appendCredentialsEnv(ctx *sdk.Context, cmd *exec.Cmd) {
+	if c := ctx.Creds; c != nil {
+		cmd.Env = append(cmd.Env,
+			"AWS_SESSION_TOKEN="+*c.SessionToken,
+			"AWS_SECRET_ACCESS_KEY="+*c.SecretAccessKey,
+			"AWS_ACCESS_KEY_ID="+*c.AccessKeyId,
+		)
+	}
+}
@@ -0,0 +1,46 @@
+package helmfile
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+func TestRunCommandWithFullOutput(t *testing.T) {
+	fs := &ReleaseSet{}
+
+	// sdk.Context.Run would keep only the last 8KB of the output
+	st, err := runCommandWithFullOutput(&sdk.Context{}, fs, exec.Command("sh", "-c", "echo first; seq 1 10000; echo last >&2"), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.HasPrefix(st.Output, "first\n1\n") || !strings.HasSuffix(st.Output, "10000\nlast\n") {
+		t.Errorf("expected the whole output, got %d bytes beginning with %q", len(st.Output), st.Output[:10])
+	}
+
+	st, err = runCommandWithFullOutput(&sdk.Context{}, fs, exec.Command("sh", "-c", "echo changes; exit 2"), true)
+	if err != nil {
+		t.Fatalf("expected the exit status 2 to be a success: %v", err)
+	}
+
+	if st.Output != "changes\n" {
+		t.Errorf("expected the diff output, got %q", st.Output)
+	}
+
+	st, err = runCommandWithFullOutput(&sdk.Context{}, fs, exec.Command("sh", "-c", "echo nochanges"), true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if st.Output != "" {
+		t.Errorf("expected no diff output on the exit status 0, got %q", st.Output)
+	}
+
+	_, err = runCommandWithFullOutput(&sdk.Context{}, fs, exec.Command("sh", "-c", "echo failure; exit 1"), false)
+	if err == nil || !strings.Contains(err.Error(), "failure") {
+		t.Errorf("expected the error to contain the output, got %v", err)
+	}
+}
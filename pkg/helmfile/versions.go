@@ -0,0 +1,222 @@
+package helmfile
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/semver"
+)
+
+const KeyResolvedHelmfileVersion = "resolved_helmfile_version"
+const KeyResolvedHelmVersion = "resolved_helm_version"
+const KeyResolvedHelmDiffVersion = "resolved_helm_diff_version"
+
+const (
+	DefaultHelmfileBinary = "helmfile"
+	DefaultHelmBinary     = "helm"
+)
+
+// ResolvedVersions is the set of concrete versions of binaries and the helm-diff plugin used for a release set
+type ResolvedVersions struct {
+	Helmfile string
+	Helm     string
+	HelmDiff string
+}
+
+var (
+	binaryVersionsMu sync.Mutex
+
+	// binaryVersions caches versions of binaries keyed by paths and modification times of the binaries,
+	// so that we don't need to run e.g. `helmfile --version` for every helmfile command the provider runs.
+	binaryVersions = map[string]string{}
+)
+
+// detectBinaryVersion runs the binary with args to print its version and returns the version number without the `v` prefix
+// nor the build metadata.
+func detectBinaryVersion(bin string, args ...string) (string, error) {
+	path, err := exec.LookPath(bin)
+	if err != nil {
+		return "", fmt.Errorf("looking up %s: %w", bin, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	cacheKey := fmt.Sprintf("%s@%d", path, info.ModTime().UnixNano())
+
+	binaryVersionsMu.Lock()
+	defer binaryVersionsMu.Unlock()
+
+	if v, ok := binaryVersions[cacheKey]; ok {
+		return v, nil
+	}
+
+	out, err := exec.Command(path, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("running %s %s: %w\nCOMBINED OUTPUT:\n%s", path, strings.Join(args, " "), err, string(out))
+	}
+
+	v, err := parseVersionOutput(string(out))
+	if err != nil {
+		return "", fmt.Errorf("parsing output of %s %s: %w", path, strings.Join(args, " "), err)
+	}
+
+	binaryVersions[cacheKey] = v
+
+	return v, nil
+}
+
+// parseVersionOutput extracts the version number from outputs like `helmfile version v0.138.7` or `v3.5.4+g1b5edb6`
+func parseVersionOutput(out string) (string, error) {
+	fields := strings.Fields(strings.TrimSpace(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no version found in %q", out)
+	}
+
+	versionPart := fields[len(fields)-1]
+	versionPart = strings.SplitN(versionPart, "+", 2)[0]
+	versionPart = strings.TrimLeft(versionPart, "v")
+
+	v, err := semver.NewVersion(versionPart)
+	if err != nil {
+		return "", fmt.Errorf("parsing %q as semver: %w", versionPart, err)
+	}
+
+	return v.String(), nil
+}
+
+func detectHelmfileVersion(bin string) (string, error) {
+	return detectBinaryVersion(bin, "--version")
+}
+
+func detectHelmVersion(bin string) (string, error) {
+	return detectBinaryVersion(bin, "version", "--short", "--client")
+}
+
+// checkVersionConstraint returns an error when the version of the locally configured binary doesn't satisfy the constraint
+func checkVersionConstraint(name, bin, version, constraint string) error {
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return fmt.Errorf("parsing version constraint %q for %s: %w", constraint, name, err)
+	}
+
+	v, err := semver.NewVersion(version)
+	if err != nil {
+		return fmt.Errorf("parsing version %q of %s: %w", version, bin, err)
+	}
+
+	if !c.Check(v) {
+		return fmt.Errorf("%s binary %s is at version %s which doesn't satisfy the version constraint %q", name, bin, version, constraint)
+	}
+
+	return nil
+}
+
+// isLocalBinary returns true when the user explicitly configured the path to the binary
+func isLocalBinary(bin, defaultBin string) bool {
+	return bin != "" && bin != defaultBin
+}
+
+// resolveVersions prepares binaries for the release set and returns concrete versions of them
+func resolveVersions(fs *ReleaseSet) (*ResolvedVersions, error) {
+	bins, err := prepareBinaries(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var r ResolvedVersions
+
+	r.Helmfile, err = detectHelmfileVersion(bins.Helmfile)
+	if err != nil {
+		return nil, fmt.Errorf("detecting helmfile version: %w", err)
+	}
+
+	helmBin := bins.Helm
+	if helmBin == "" {
+		helmBin = DefaultHelmBinary
+	}
+
+	r.Helm, err = detectHelmVersion(helmBin)
+	if err != nil {
+		return nil, fmt.Errorf("detecting helm version: %w", err)
+	}
+
+	plugins, err := listHelmPlugins(helmBin, bins.Env)
+	if err != nil {
+		return nil, fmt.Errorf("detecting helm-diff version: %w", err)
+	}
+
+	r.HelmDiff = plugins["diff"]
+
+	return &r, nil
+}
+
+// hasVersionConstraints returns true when the user asked for specific versions of any of helmfile, helm and helm-diff
+func hasVersionConstraints(fs *ReleaseSet) bool {
+	return fs.Version != "" || fs.HelmVersion != "" || fs.HelmDiffVersion != ""
+}
+
+// recordResolvedVersions sets resolved versions of binaries to the resource.
+//
+// With strict=true, it fails when the resolved version differs from the planned one, so that a semver range like `~0.138`
+// never silently moves to another version between plan and apply.
+//
+// Versions are resolved only when any of version, helm_version and helm_diff_version is set,
+// so that plans for release sets using binaries on the host don't run extra processes nor need helm plugins to be listable.
+func recordResolvedVersions(fs *ReleaseSet, d ResourceReadWrite, strict bool) error {
+	if !hasVersionConstraints(fs) {
+		if strict {
+			return nil
+		}
+
+		// Versions recorded before the constraints were removed are cleared, so that they never look current
+		for _, k := range []string{KeyResolvedHelmfileVersion, KeyResolvedHelmVersion, KeyResolvedHelmDiffVersion} {
+			if v := d.Get(k); v == nil || v.(string) == "" {
+				continue
+			}
+
+			if err := d.Set(k, ""); err != nil {
+				return fmt.Errorf("setting %s: %w", k, err)
+			}
+		}
+
+		return nil
+	}
+
+	r, err := resolveVersions(fs)
+	if err != nil {
+		return fmt.Errorf("resolving versions: %w", err)
+	}
+
+	resolved := map[string]string{
+		KeyResolvedHelmfileVersion: r.Helmfile,
+		KeyResolvedHelmVersion:     r.Helm,
+		KeyResolvedHelmDiffVersion: r.HelmDiff,
+	}
+
+	for _, k := range []string{KeyResolvedHelmfileVersion, KeyResolvedHelmVersion, KeyResolvedHelmDiffVersion} {
+		var planned string
+		if v := d.Get(k); v != nil {
+			planned = v.(string)
+		}
+
+		if planned == resolved[k] {
+			continue
+		}
+
+		if strict && planned != "" {
+			return fmt.Errorf("%s has changed from %s to %s since the plan. Re-run plan to review changes with the new version", k, planned, resolved[k])
+		}
+
+		if err := d.Set(k, resolved[k]); err != nil {
+			return fmt.Errorf("setting %s: %w", k, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package helmfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/helper/schema"
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+)
+
+func TestParseVersionOutput(t *testing.T) {
+	testcases := map[string]string{
+		"helmfile version v0.138.7\n": "0.138.7",
+		"helmfile version 0.128.1":    "0.128.1",
+		"v3.5.4+g1b5edb6\n":           "3.5.4",
+		"Client: v2.16.1+gbbdfe5e":    "2.16.1",
+	}
+
+	for out, want := range testcases {
+		got, err := parseVersionOutput(out)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", out, err)
+		}
+		if got != want {
+			t.Errorf("unexpected version for %q: want %s, got %s", out, want, got)
+		}
+	}
+
+	if _, err := parseVersionOutput("unknown"); err == nil {
+		t.Errorf("expected error for non-semver output")
+	}
+}
+
+func TestCheckVersionConstraint(t *testing.T) {
+	if err := checkVersionConstraint("helmfile", "/usr/local/bin/helmfile", "0.138.7", "~0.138"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if err := checkVersionConstraint("helmfile", "/usr/local/bin/helmfile", "0.139.0", "~0.138"); err == nil {
+		t.Errorf("expected error for version not satisfying the constraint")
+	}
+}
+
+func TestCreateReleaseSet_VersionChangedSinceThePlan(t *testing.T) {
+	dir := t.TempDir()
+
+	applied := filepath.Join(dir, "applied")
+
+	scripts := map[string]string{
+		"helmfile": "#!/bin/sh\ncase \"$*\" in\n*--version*) echo helmfile version v0.139.0 ;;\n*apply*) touch " + applied + " ;;\nesac\n",
+		"helm":     "#!/bin/sh\ncase \"$*\" in\n*version*) echo v3.5.4+g1b5edb6 ;;\n*plugin*) printf 'NAME VERSION DESCRIPTION\\ndiff 3.1.3 diff\\n' ;;\nesac\n",
+	}
+
+	for name, script := range scripts {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs := &ReleaseSet{
+		Bin:              filepath.Join(dir, "helmfile"),
+		Version:          ">= 0.138",
+		HelmBin:          filepath.Join(dir, "helm"),
+		Content:          "releases: []\n",
+		Kubeconfig:       filepath.Join(dir, "kubeconfig"),
+		WorkingDirectory: dir,
+	}
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{
+		KeyKubeconfig:              fs.Kubeconfig,
+		KeyResolvedHelmfileVersion: "0.138.7",
+	})
+
+	err := CreateReleaseSet(&sdk.Context{}, fs, d)
+	if err == nil || !strings.Contains(err.Error(), "has changed from 0.138.7 to 0.139.0") {
+		t.Fatalf("expected the version change to be detected, got %v", err)
+	}
+
+	if _, err := os.Stat(applied); err == nil {
+		t.Errorf("expected helmfile-apply not to be run")
+	}
+}
+
+func TestRecordResolvedVersions_WithoutConstraints(t *testing.T) {
+	// Binaries are never run without version constraints
+	fs := &ReleaseSet{
+		Bin:     "/nonexistent/helmfile",
+		HelmBin: "/nonexistent/helm",
+	}
+
+	d := schema.TestResourceDataRaw(t, ReleaseSetSchema, map[string]interface{}{})
+
+	if err := d.Set(KeyResolvedHelmfileVersion, "0.138.7"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := recordResolvedVersions(fs, d, true); err != nil {
+		t.Fatalf("unexpected error on apply: %v", err)
+	}
+
+	if err := recordResolvedVersions(fs, d, false); err != nil {
+		t.Fatalf("unexpected error on plan: %v", err)
+	}
+
+	if v := d.Get(KeyResolvedHelmfileVersion).(string); v != "" {
+		t.Errorf("expected the outdated version to be cleared on plan, got %s", v)
+	}
+}
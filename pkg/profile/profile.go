@@ -1,37 +1,132 @@
 package profile
 
 import (
-	"fmt"
-	"github.com/pkg/profile"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
 	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/profile"
+)
+
+const (
+	// EnvProfile is the name of the environment variable to select the profile written on exit
+	EnvProfile = "TF_HELMFILE_PROFILE"
+	// EnvProfilePath is the name of the environment variable for the directory that the profile is written into
+	EnvProfilePath = "TF_HELMFILE_PROFILE_PATH"
+	// EnvPprofAddr is the name of the environment variable for the address the live pprof HTTP listener binds to, like localhost:6060
+	EnvPprofAddr = "TF_HELMFILE_PPROF_ADDR"
 )
 
+// modes maps supported values of TF_HELMFILE_PROFILE to profiles
+var modes = map[string]func(*profile.Profile){
+	"cpu":       profile.CPUProfile,
+	"mem":       profile.MemProfile,
+	"block":     profile.BlockProfile,
+	"mutex":     profile.MutexProfile,
+	"goroutine": profile.GoroutineProfile,
+	"trace":     profile.TraceProfile,
+}
+
+// Start starts the profile selected by TF_HELMFILE_PROFILE and the pprof HTTP listener on TF_HELMFILE_PPROF_ADDR.
+// Invalid settings are logged as warnings and ignored, so that they never prevent the provider from running.
 func Start() interface{ Stop() } {
-	var opts []func(*profile.Profile)
+	var stoppers stoppers
 
-	switch p := os.Getenv("TF_HELMFILE_PROFILE"); p {
-	case "mem":
-		opts = append(opts, profile.MemProfile)
-	case "cpu":
-		opts = append(opts, profile.CPUProfile)
-	case "":
-		// Do nothing
-		return noopProfiler{}
-	default:
-		panic(fmt.Sprintf("Unsupported TF_HELMFILE_PROFILE=%s: Supported values are %q and %q", p, "mem", "cpu"))
+	if p := startProfile(os.Getenv(EnvProfile), os.Getenv(EnvProfilePath)); p != nil {
+		stoppers = append(stoppers, p)
 	}
 
-	if p := os.Getenv("TF_HELMFILE_PROFILE_PATH"); p != "" {
-		opts = append(opts, profile.ProfilePath(p))
+	if s := startPprofServer(os.Getenv(EnvPprofAddr)); s != nil {
+		stoppers = append(stoppers, s)
 	}
 
-	profiler := profile.Start(opts...)
+	return stoppers
+}
+
+func startProfile(mode, path string) interface{ Stop() } {
+	if mode == "" {
+		return nil
+	}
 
-	return profiler
+	opt, ok := modes[mode]
+	if !ok {
+		log.Printf("[WARN] Ignoring unsupported %s=%s: Supported values are %s", EnvProfile, mode, strings.Join(supportedModes(), ", "))
+
+		return nil
+	}
+
+	opts := []func(*profile.Profile){opt}
+
+	if path != "" {
+		opts = append(opts, profile.ProfilePath(path))
+	}
+
+	return profile.Start(opts...)
 }
 
-type noopProfiler struct{}
+func supportedModes() []string {
+	var names []string
+
+	for m := range modes {
+		names = append(names, m)
+	}
 
-func (_ noopProfiler) Stop() {
+	sort.Strings(names)
 
+	return names
+}
+
+// startPprofServer serves the pprof endpoints under /debug/pprof/ to inspect the long-running plugin process
+func startPprofServer(addr string) interface{ Stop() } {
+	if addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("[WARN] Ignoring %s=%s: %v", EnvPprofAddr, addr, err)
+
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Printf("[WARN] pprof listener on %s stopped: %v", l.Addr(), err)
+		}
+	}()
+
+	log.Printf("[INFO] Serving pprof on http://%s/debug/pprof/", l.Addr())
+
+	return pprofServer{srv: srv, addr: l.Addr()}
+}
+
+type pprofServer struct {
+	srv  *http.Server
+	addr net.Addr
+}
+
+func (s pprofServer) Stop() {
+	s.srv.Close()
+}
+
+// stoppers stops the profile and the listener in the reverse order they were started
+type stoppers []interface{ Stop() }
+
+func (ss stoppers) Stop() {
+	for i := len(ss) - 1; i >= 0; i-- {
+		ss[i].Stop()
+	}
 }
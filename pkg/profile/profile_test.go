@@ -0,0 +1,35 @@
+package profile
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestStartProfileUnsupportedMode(t *testing.T) {
+	if p := startProfile("heap", ""); p != nil {
+		t.Errorf("expected no profile for the unsupported mode")
+	}
+}
+
+func TestStartPprofServer(t *testing.T) {
+	s := startPprofServer("127.0.0.1:0")
+	if s == nil {
+		t.Fatal("expected the pprof listener to start")
+	}
+	defer s.Stop()
+
+	res, err := http.Get(fmt.Sprintf("http://%s/debug/pprof/", s.(pprofServer).addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("unexpected status: %s", res.Status)
+	}
+
+	if s := startPprofServer("invalid:address:0"); s != nil {
+		t.Errorf("expected no listener for the invalid address")
+	}
+}
@@ -0,0 +1,15 @@
+// Package releaseset is the Go API to plan, apply, destroy, template and build helmfile release sets
+// without going through Terraform.
+//
+// It's the stable API for programs embedding this provider's functionality. Only plain Go types are used in the API,
+// so that embedders don't depend on the Terraform plugin SDK or the internals of the provider.
+// Backward-incompatible changes to the API are made only along with a bump of APIVersion.
+//
+// Every operation runs helmfile and related binaries as child processes, which are killed when the context is done.
+//
+// Plan caches the helmfile-diff result under `.terraform/helmfile` in the current working directory,
+// the same as the provider does, so that a subsequent Apply or Plan for the same desired state is consistent with it.
+package releaseset
+
+// APIVersion is the version of this package's API
+const APIVersion = "v1"
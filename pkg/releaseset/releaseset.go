@@ -0,0 +1,353 @@
+package releaseset
+
+import (
+	"context"
+	"time"
+
+	"github.com/mumoshu/terraform-provider-eksctl/pkg/sdk"
+	"github.com/mumoshu/terraform-provider-helmfile/pkg/helmfile"
+)
+
+// Logger receives log messages emitted while running helmfile. *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// ReleaseSet is the desired state of a set of releases managed by helmfile.
+// Fields correspond to attributes of the helmfile_release_set resource.
+type ReleaseSet struct {
+	// Content is the content of helmfile.yaml
+	Content string
+
+	// WorkingDirectory is the directory that helmfile runs in. Relative paths in Content are resolved against it.
+	WorkingDirectory string
+
+	// Kubeconfig is the path to the kubeconfig file used to access the cluster
+	Kubeconfig string
+
+	Environment string
+
+	// Values is the list of YAML or JSON documents passed to helmfile as state values
+	Values []string
+
+	// ValuesFiles is the list of paths to state values files
+	ValuesFiles []string
+
+	// Selector is a AND list of label key-value pairs to select releases
+	Selector map[string]string
+
+	// Selectors is a OR list of helmfile label selectors like `name=foo,tier=frontend`
+	Selectors []string
+
+	// ReleasesValues is passed to helmfile via `--set` flags
+	ReleasesValues map[string]string
+
+	EnvironmentVariables map[string]string
+
+	Concurrency int
+
+	// Bin and HelmBin are paths to helmfile and helm binaries. They default to the ones found in PATH.
+	Bin     string
+	HelmBin string
+
+	// Version, HelmVersion, KubectlVersion and KustomizeVersion are version numbers or semver version ranges
+	// of binaries to be installed before running helmfile.
+	Version          string
+	HelmVersion      string
+	HelmDiffVersion  string
+	KubectlVersion   string
+	KustomizeVersion string
+
+	// HelmPlugins is the map of names to versions or sources of helm plugins to be installed
+	HelmPlugins map[string]string
+
+	// BinaryCacheDir is the directory to install binaries and helm plugins into
+	BinaryCacheDir string
+
+	// ShoalSyncTimeout is the maximum duration to wait for binaries and helm plugins to be installed
+	ShoalSyncTimeout time.Duration
+
+	// AWSRegion and AWSProfile are used to obtain AWS credentials for helmfile, e.g. for the helm-s3 plugin
+	AWSRegion  string
+	AWSProfile string
+}
+
+// Options is the set of options common to all the operations
+type Options struct {
+	ReleaseSet ReleaseSet
+
+	// Logger receives log messages. Messages are written to the standard logger when nil.
+	Logger Logger
+}
+
+// PlanOptions is the options for Plan
+type PlanOptions struct {
+	Options
+
+	// DryRun computes the diff from rendered manifests without accessing the cluster, as if none of the releases
+	// were installed. Use it to plan releases for a cluster that is yet to be created.
+	DryRun bool
+}
+
+// ApplyOptions is the options for Apply
+type ApplyOptions struct {
+	Options
+}
+
+// DestroyOptions is the options for Destroy
+type DestroyOptions struct {
+	Options
+}
+
+// TemplateOptions is the options for Template
+type TemplateOptions struct {
+	Options
+}
+
+// BuildOptions is the options for Build
+type BuildOptions struct {
+	Options
+
+	// EmbedValues embeds the content of values files into the output
+	EmbedValues bool
+}
+
+// PlanResult is the result of Plan
+type PlanResult struct {
+	// Output is the helmfile-diff output, that is empty when there are no changes
+	Output string
+
+	// Releases is the list of changed releases
+	Releases []ReleaseChange
+}
+
+// HasChanges returns true when applying the release set changes anything in the cluster
+func (p *PlanResult) HasChanges() bool {
+	return p.Output != ""
+}
+
+// ReleaseChange is the set of resource changes planned for a release
+type ReleaseChange struct {
+	Name  string
+	Chart string
+
+	Resources []ResourceChange
+}
+
+const (
+	ResourceAdded   = helmfile.ResourceAdded
+	ResourceChanged = helmfile.ResourceChanged
+	ResourceRemoved = helmfile.ResourceRemoved
+)
+
+// ResourceChange is a planned change on a Kubernetes resource
+type ResourceChange struct {
+	Namespace string
+	Name      string
+	Kind      string
+	APIGroup  string
+
+	// Change is one of ResourceAdded, ResourceChanged and ResourceRemoved
+	Change string
+
+	// Diff is the unified diff of the resource
+	Diff string
+}
+
+// ApplyResult is the result of Apply
+type ApplyResult struct {
+	// Output is the helmfile-apply output
+	Output string
+
+	// HelmfileVersion, HelmVersion and HelmDiffVersion are the versions of binaries and the plugin used for the apply
+	HelmfileVersion string
+	HelmVersion     string
+	HelmDiffVersion string
+}
+
+// Plan runs helmfile-diff and returns the changes to be made by Apply
+func Plan(ctx context.Context, opts PlanOptions) (*PlanResult, error) {
+	fs, sdkCtx, d := opts.prepare(ctx)
+
+	output, err := helmfile.DiffReleaseSet(sdkCtx, fs, d, helmfile.WithDiffConfig(helmfile.DiffConfig{
+		DryRun: opts.DryRun,
+		// Embedders get the full diff, as there's no Terraform plan to be bloated by it
+		MaxDiffOutputLen: int(^uint(0) >> 1),
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return newPlan(output), nil
+}
+
+// Apply runs helmfile-apply to install or upgrade releases
+func Apply(ctx context.Context, opts ApplyOptions) (*ApplyResult, error) {
+	fs, sdkCtx, d := opts.prepare(ctx)
+
+	if err := helmfile.CreateReleaseSet(sdkCtx, fs, d); err != nil {
+		return nil, err
+	}
+
+	return &ApplyResult{
+		Output:          d.getString(helmfile.KeyApplyOutput),
+		HelmfileVersion: d.getString(helmfile.KeyResolvedHelmfileVersion),
+		HelmVersion:     d.getString(helmfile.KeyResolvedHelmVersion),
+		HelmDiffVersion: d.getString(helmfile.KeyResolvedHelmDiffVersion),
+	}, nil
+}
+
+// Destroy runs helmfile-destroy to uninstall releases
+func Destroy(ctx context.Context, opts DestroyOptions) error {
+	fs, sdkCtx, d := opts.prepare(ctx)
+
+	return helmfile.DeleteReleaseSet(sdkCtx, fs, d)
+}
+
+// Template runs helmfile-template and returns the rendered manifests
+func Template(ctx context.Context, opts TemplateOptions) (string, error) {
+	fs, sdkCtx, _ := opts.prepare(ctx)
+
+	return helmfile.TemplateReleaseSet(sdkCtx, fs)
+}
+
+// Build runs helmfile-build and returns the helmfile state after all the templates and values are processed
+func Build(ctx context.Context, opts BuildOptions) (string, error) {
+	fs, sdkCtx, _ := opts.prepare(ctx)
+
+	return helmfile.BuildReleaseSet(sdkCtx, fs, opts.EmbedValues)
+}
+
+func (o Options) prepare(ctx context.Context) (*helmfile.ReleaseSet, *sdk.Context, *resource) {
+	fs := newReleaseSet(o.ReleaseSet)
+	fs.Context = ctx
+	fs.Logger = o.Logger
+
+	sdkCtx := sdk.ContextConfig(&sdk.Config{
+		Region:  o.ReleaseSet.AWSRegion,
+		Profile: o.ReleaseSet.AWSProfile,
+	})
+
+	return fs, sdkCtx, &resource{m: map[string]interface{}{}}
+}
+
+func newReleaseSet(rs ReleaseSet) *helmfile.ReleaseSet {
+	fs := &helmfile.ReleaseSet{
+		Bin:              rs.Bin,
+		HelmBin:          rs.HelmBin,
+		Content:          rs.Content,
+		Environment:      rs.Environment,
+		WorkingDirectory: rs.WorkingDirectory,
+		Kubeconfig:       rs.Kubeconfig,
+		Concurrency:      rs.Concurrency,
+		Version:          rs.Version,
+		HelmVersion:      rs.HelmVersion,
+		HelmDiffVersion:  rs.HelmDiffVersion,
+		KubectlVersion:   rs.KubectlVersion,
+		KustomizeVersion: rs.KustomizeVersion,
+		BinaryCacheDir:   rs.BinaryCacheDir,
+		ShoalSyncTimeout: rs.ShoalSyncTimeout,
+		Selectors:        toInterfaces(rs.Selectors),
+		Values:           toInterfaces(rs.Values),
+		ValuesFiles:      toInterfaces(rs.ValuesFiles),
+	}
+
+	if fs.Bin == "" {
+		fs.Bin = helmfile.DefaultHelmfileBinary
+	}
+
+	if fs.HelmBin == "" {
+		fs.HelmBin = helmfile.DefaultHelmBinary
+	}
+
+	if len(rs.Selector) > 0 {
+		fs.Selector = toInterfaceMap(rs.Selector)
+	}
+
+	if len(rs.ReleasesValues) > 0 {
+		fs.ReleasesValues = toInterfaceMap(rs.ReleasesValues)
+	}
+
+	if len(rs.EnvironmentVariables) > 0 {
+		fs.EnvironmentVariables = toInterfaceMap(rs.EnvironmentVariables)
+	}
+
+	if len(rs.HelmPlugins) > 0 {
+		fs.HelmPlugins = toInterfaceMap(rs.HelmPlugins)
+	}
+
+	return fs
+}
+
+func newPlan(output string) *PlanResult {
+	p := &PlanResult{Output: output}
+
+	for _, r := range helmfile.ParseDiffOutput(output) {
+		rc := ReleaseChange{Name: r.Name, Chart: r.Chart}
+
+		for _, res := range r.Resources {
+			rc.Resources = append(rc.Resources, ResourceChange{
+				Namespace: res.Namespace,
+				Name:      res.Name,
+				Kind:      res.Kind,
+				APIGroup:  res.APIGroup,
+				Change:    res.Change,
+				Diff:      res.Diff,
+			})
+		}
+
+		p.Releases = append(p.Releases, rc)
+	}
+
+	return p
+}
+
+func toInterfaces(ss []string) []interface{} {
+	var is []interface{}
+
+	for _, s := range ss {
+		is = append(is, s)
+	}
+
+	return is
+}
+
+func toInterfaceMap(m map[string]string) map[string]interface{} {
+	im := map[string]interface{}{}
+
+	for k, v := range m {
+		im[k] = v
+	}
+
+	return im
+}
+
+// resource is the in-memory replacement of the Terraform resource data, that receives attributes computed by operations
+type resource struct {
+	m map[string]interface{}
+}
+
+func (r *resource) Id() string {
+	return ""
+}
+
+func (r *resource) Get(k string) interface{} {
+	return r.m[k]
+}
+
+func (r *resource) Set(k string, v interface{}) error {
+	r.m[k] = v
+
+	return nil
+}
+
+func (r *resource) getString(k string) string {
+	v, ok := r.m[k].(string)
+	if !ok {
+		return ""
+	}
+
+	return v
+}
+
+var _ helmfile.ResourceReadWrite = &resource{}
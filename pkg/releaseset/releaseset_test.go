@@ -0,0 +1,72 @@
+package releaseset
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mumoshu/terraform-provider-helmfile/pkg/helmfile"
+)
+
+func TestNewPlan(t *testing.T) {
+	output := `Comparing release=podinfo, chart=sp/podinfo
+default, podinfo, Deployment (apps) has changed:
+-   replicas: 1
++   replicas: 2
+`
+
+	want := &PlanResult{
+		Output: output,
+		Releases: []ReleaseChange{
+			{
+				Name:  "podinfo",
+				Chart: "sp/podinfo",
+				Resources: []ResourceChange{
+					{
+						Namespace: "default",
+						Name:      "podinfo",
+						Kind:      "Deployment",
+						APIGroup:  "apps",
+						Change:    ResourceChanged,
+						Diff:      "-   replicas: 1\n+   replicas: 2\n",
+					},
+				},
+			},
+		},
+	}
+
+	got := newPlan(output)
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected plan:\nwant: %+v\ngot:  %+v", want, got)
+	}
+
+	if !got.HasChanges() {
+		t.Errorf("expected changes")
+	}
+
+	if newPlan("").HasChanges() {
+		t.Errorf("expected no changes for empty output")
+	}
+}
+
+func TestNewReleaseSet(t *testing.T) {
+	fs := newReleaseSet(ReleaseSet{
+		Content:        "releases: []",
+		Selector:       map[string]string{"tier": "frontend"},
+		Values:         []string{"foo: bar"},
+		ReleasesValues: map[string]string{"podinfo.replicaCount": "2"},
+	})
+
+	want := &helmfile.ReleaseSet{
+		Bin:            helmfile.DefaultHelmfileBinary,
+		HelmBin:        helmfile.DefaultHelmBinary,
+		Content:        "releases: []",
+		Selector:       map[string]interface{}{"tier": "frontend"},
+		Values:         []interface{}{"foo: bar"},
+		ReleasesValues: map[string]interface{}{"podinfo.replicaCount": "2"},
+	}
+
+	if !reflect.DeepEqual(fs, want) {
+		t.Errorf("unexpected release set:\nwant: %+v\ngot:  %+v", want, fs)
+	}
+}